@@ -0,0 +1,208 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+const (
+	tcpEstablished = "01"
+	tcpTimeWait    = "06"
+	tcpCloseWait   = "08"
+)
+
+// Upper bounds in seconds of the buckets of the connection age histograms,
+// from short requests to connections stuck for a day.
+var connectionAgeBuckets = []float64{10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600}
+
+// closingStates are the states of sockets closed by the local application,
+// which are orphaned by the kernel and lose their inode until they are gone.
+var closingStates = map[string]bool{
+	"04": true, // FIN_WAIT1
+	"05": true, // FIN_WAIT2
+	"06": true, // TIME_WAIT
+	"09": true, // LAST_ACK
+	"0B": true, // CLOSING
+}
+
+// Ages are reported for these states, CLOSE_WAIT connections aging being
+// the sign of an application not closing its sockets.
+var connectionAgeStates = []string{tcpEstablished, tcpCloseWait}
+
+// connectionKey identifies a tcp connection by its addresses, as sockets in
+// TIME_WAIT have no inode anymore.
+type connectionKey struct {
+	localIp    string
+	localPort  uint16
+	remoteIp   string
+	remotePort uint16
+}
+
+type connection struct {
+	inode   uint64
+	inbound bool
+	// state is the state the connection was last seen in.
+	state string
+	// firstSeen is the collection the connection was first seen at, which
+	// is later than its opening for the connections of the first collection.
+	firstSeen time.Time
+	// closed is set once the connection has been counted as closed, when it
+	// is still seen in TIME_WAIT.
+	closed bool
+}
+
+// trackedConnections are the connections of a container seen at its last
+// collection.
+type trackedConnections struct {
+	timestamp   time.Time
+	connections map[connectionKey]*connection
+	total       types.ChurnStat
+}
+
+// connTracker follows the tcp connections of each container between
+// collections to count the ones opened and closed meanwhile, and to estimate
+// their age.
+type connTracker struct {
+	lock       sync.Mutex
+	containers map[string]*trackedConnections
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		containers: make(map[string]*trackedConnections),
+	}
+}
+
+// update compares the sockets of container name with the ones seen at its
+// previous collection. A connection both opened and closed between two
+// collections is only counted when it is left in TIME_WAIT, which is the
+// case on the side closing it first. The age histograms of the connections
+// in connectionAgeStates are returned as well.
+func (ct *connTracker) update(name string, sockets []socket) (*types.ConnectionChurnStat, []types.ConnectionAgeStat) {
+	now := time.Now()
+	ct.lock.Lock()
+	tracked, ok := ct.containers[name]
+	if !ok {
+		tracked = &trackedConnections{}
+		ct.containers[name] = tracked
+	}
+	ct.lock.Unlock()
+
+	listening := make(map[uint16]bool)
+	for _, s := range sockets {
+		if s.state == tcpListen {
+			listening[s.localPort] = true
+		}
+	}
+
+	var churn types.ChurnStat
+	ages := make(map[string][]float64, len(connectionAgeStates))
+	connections := make(map[connectionKey]*connection, len(sockets))
+	for _, s := range sockets {
+		if s.state == tcpListen {
+			continue
+		}
+		key := connectionKey{s.localIp.String(), s.localPort, s.remoteIp.String(), s.remotePort}
+		timeWait := s.state == tcpTimeWait
+
+		conn, seen := tracked.connections[key]
+		if seen && s.inode != 0 && conn.inode != s.inode && !closingStates[conn.state] {
+			// the addresses are reused by a new connection, as orphaned
+			// sockets have no inode
+			if !conn.closed {
+				addChurn(&churn, conn.inbound, false)
+			}
+			seen = false
+		}
+		if !seen {
+			conn = &connection{inode: s.inode, inbound: listening[s.localPort], firstSeen: now}
+			// the first collection of a container only sets the baseline
+			if tracked.connections != nil {
+				addChurn(&churn, conn.inbound, true)
+			}
+		}
+		if timeWait && !conn.closed {
+			conn.closed = true
+			if tracked.connections != nil {
+				addChurn(&churn, conn.inbound, false)
+			}
+		}
+		conn.state = s.state
+		connections[key] = conn
+		ages[s.state] = append(ages[s.state], now.Sub(conn.firstSeen).Seconds())
+	}
+	for key, conn := range tracked.connections {
+		if _, ok := connections[key]; !ok && !conn.closed {
+			addChurn(&churn, conn.inbound, false)
+		}
+	}
+
+	tracked.timestamp = now
+	tracked.connections = connections
+	tracked.total.InboundOpened += churn.InboundOpened
+	tracked.total.InboundClosed += churn.InboundClosed
+	tracked.total.OutboundOpened += churn.OutboundOpened
+	tracked.total.OutboundClosed += churn.OutboundClosed
+	churnStat := &types.ConnectionChurnStat{
+		Interval: churn,
+		Total:    tracked.total,
+	}
+
+	ageStats := make([]types.ConnectionAgeStat, 0, len(connectionAgeStates))
+	for _, state := range connectionAgeStates {
+		ageStats = append(ageStats, connectionAgeStat(tcpStateNames[state], ages[state]))
+	}
+	return churnStat, ageStats
+}
+
+// connectionAgeStat builds the histogram of ages in seconds, with cumulative
+// buckets as prometheus histograms.
+func connectionAgeStat(state string, ages []float64) types.ConnectionAgeStat {
+	stat := types.ConnectionAgeStat{
+		State:   state,
+		Buckets: make([]types.AgeBucket, len(connectionAgeBuckets)),
+	}
+	for i, bound := range connectionAgeBuckets {
+		stat.Buckets[i].UpperBound = bound
+	}
+	for _, age := range ages {
+		stat.Count++
+		stat.Sum += age
+		if age > stat.Max {
+			stat.Max = age
+		}
+		for i, bound := range connectionAgeBuckets {
+			if age <= bound {
+				stat.Buckets[i].Count++
+			}
+		}
+	}
+	return stat
+}
+
+// expire forgets the containers which have not been collected for a while.
+func (ct *connTracker) expire() {
+	now := time.Now()
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	for name, tracked := range ct.containers {
+		if now.Sub(tracked.timestamp) > 2*(*interval) {
+			delete(ct.containers, name)
+		}
+	}
+}
+
+func addChurn(stat *types.ChurnStat, inbound, opened bool) {
+	switch {
+	case inbound && opened:
+		stat.InboundOpened++
+	case inbound:
+		stat.InboundClosed++
+	case opened:
+		stat.OutboundOpened++
+	default:
+		stat.OutboundClosed++
+	}
+}
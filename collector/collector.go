@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,6 +19,7 @@ import (
 	info "github.com/google/cadvisor/info/v1"
 
 	"github.com/yanqing-exporter/collector/cadvisor"
+	"github.com/yanqing-exporter/collector/kubernetes"
 	"github.com/yanqing-exporter/collector/types"
 	"github.com/yanqing-exporter/collector/watcher"
 	"github.com/yanqing-exporter/container/docker"
@@ -28,6 +30,7 @@ var (
 	interval             = flag.Duration("collect_interval", time.Second*10, "Interval between collectings")
 	rootFs               = flag.String("collector_procfs", "/host/", "Path of host proc")
 	housekeepingInterval = flag.Duration("housekeeping_interval", 1*time.Minute, "Interval between housekeepings")
+	kubernetesPeers      = flag.Bool("kubernetes_peers", false, "Resolve remote ips to kubernetes pods and services by watching the api server")
 )
 
 type Collector interface {
@@ -35,25 +38,54 @@ type Collector interface {
 	Stop() error
 }
 
-func NewCollector(cacheStorage storage.Storage, cadvisorClient cadvisor.Client) (Collector, error) {
+// Sink is notified at the end of every collection, once the stats are stored.
+type Sink interface {
+	Collected()
+}
+
+func NewCollector(cacheStorage storage.Storage, cadvisorClient cadvisor.Client, sinks ...Sink) (Collector, error) {
+	if *ephemeralPortTopN < 0 {
+		return nil, fmt.Errorf("invalid ephemeral_port_top_n %d", *ephemeralPortTopN)
+	}
+	if *peersTopN < 0 {
+		return nil, fmt.Errorf("invalid peers_top_n %d", *peersTopN)
+	}
 	dockerWatcher, err := watcher.NewWatcher(cacheStorage, cadvisorClient)
 	if nil != err {
 		return nil, err
 	}
-	return &collector{
+	c := &collector{
 		watcher:      dockerWatcher,
 		cacheStorage: cacheStorage,
-	}, nil
+		sysctls:      newSysctlCache(),
+		conns:        newConnTracker(),
+		sinks:        sinks,
+	}
+	if *kubernetesPeers {
+		// peers are still resolved to the containers of the node without it
+		c.cluster, err = kubernetes.NewIndex()
+		if err != nil {
+			glog.Errorf("Failed to create kubernetes index, remote ips will not be resolved: %v", err)
+		}
+	}
+	return c, nil
 }
 
 type collector struct {
 	watcher      watcher.Watcher
 	cacheStorage storage.Storage
+	sysctls      *sysctlCache
+	conns        *connTracker
+	cluster      *kubernetes.Index
+	sinks        []Sink
 	quitChannels []chan error
 }
 
 func (c *collector) Start() error {
 	c.watcher.Start()
+	if c.cluster != nil {
+		c.cluster.Start()
+	}
 
 	quitCollector := make(chan error)
 	c.quitChannels = append(c.quitChannels, quitCollector)
@@ -67,6 +99,9 @@ func (c *collector) Start() error {
 
 func (c *collector) Stop() error {
 	c.watcher.Stop()
+	if c.cluster != nil {
+		c.cluster.Stop()
+	}
 
 	for i, ch := range c.quitChannels {
 		ch <- nil
@@ -81,15 +116,6 @@ func (c *collector) Stop() error {
 }
 
 func (c *collector) startCollector(quit chan error) {
-	var err error
-	var wg sync.WaitGroup
-	var tcpStat info.TcpStat
-	var udpStat info.UdpStat
-	var tcp6Stat info.TcpStat
-	var udp6Stat info.UdpStat
-	var tcpExtStat types.TcpExtStat
-
-	containerInfos := make(map[string]*docker.ContainerInfo)
 	ticker := time.NewTicker(*interval)
 	go func() {
 		for {
@@ -98,63 +124,201 @@ func (c *collector) startCollector(quit chan error) {
 				quit <- nil
 				return
 			case <-ticker.C:
-				containerInfos = c.cacheStorage.GetAllContainerInfo()
-				for name, container := range containerInfos {
-					wg.Add(1)
-					go func(name string, container *docker.ContainerInfo) {
-						defer wg.Done()
-						var tcpError = false
-						var udpError = false
-						var tcpExtError = false
-						tcpStat, err = tcpStatsFromProc(*rootFs, container.Spec.Pid, "net/tcp")
-						if err != nil {
-							glog.V(2).Infof("Unable to get tcp stats from pid %d: %v", container.Spec.Pid, err)
-							tcpError = true
-						}
-
-						udpStat, err = udpStatsFromProc(*rootFs, container.Spec.Pid, "net/udp")
-						if err != nil {
-							glog.V(2).Infof("Unable to get udp stats from pid %d: %v", container.Spec.Pid, err)
-							udpError = true
-						}
-
-						tcp6Stat, err = tcpStatsFromProc(*rootFs, container.Spec.Pid, "net/tcp6")
-						if err != nil {
-							glog.V(2).Infof("Unable to get tcp6 stats from pid %d: %v", container.Spec.Pid, err)
-							tcpError = true
-						}
-
-						udp6Stat, err = udpStatsFromProc(*rootFs, container.Spec.Pid, "net/udp6")
-						if err != nil {
-							glog.V(2).Infof("Unable to get udp6 stats from pid %d: %v", container.Spec.Pid, err)
-							udpError = true
-						}
-
-						tcpExtStat, err = scanTcpExtStats(*rootFs, container.Spec.Pid, "net/netstat")
-						if err != nil {
-							glog.V(2).Infof("Unable to get tcpext stats from pid %d: %v", container.Spec.Pid, err)
-							tcpExtError = true
-						}
-
-						if !udpError && !tcpError && !tcpExtError {
-							containerStats := &docker.ContainerStats{
-								Timestamp: time.Now(),
-								Tcp:       tcpStat,
-								Udp:       udpStat,
-								Tcp6:      tcp6Stat,
-								Udp6:      udp6Stat,
-								TcpExt:    tcpExtStat,
-							}
-							c.cacheStorage.AddStats(container.Name, containerStats)
-						}
-					}(name, container)
-				}
-				wg.Wait()
+				c.collect()
 			}
 		}
 	}()
 }
 
+func (c *collector) collect() {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var hostNetns uint64
+	var hostNetworkStats []docker.NetworkStats
+	// host side ifindex of the veths of containers
+	veths := make(map[int]string)
+
+	hostStats, err := c.hostStatsFromProc(*rootFs)
+	if err != nil {
+		glog.V(2).Infof("Unable to get stats of host: %v", err)
+	} else {
+		hostNetns = hostStats.Netns
+	}
+
+	containerInfos := c.cacheStorage.GetAllContainerInfo()
+	ips := containerIps(containerInfos)
+	if hostStats != nil {
+		hostStats.Ipvs, err = ipvsStatsFromProc(*rootFs, ips)
+		if err != nil {
+			glog.V(2).Infof("Unable to get ipvs stats: %v", err)
+		}
+	}
+	for name, container := range containerInfos {
+		wg.Add(1)
+		go func(name string, container *docker.ContainerInfo) {
+			defer wg.Done()
+			containerStats, err := c.containerStatsFromProc(*rootFs, container, hostNetns, ips)
+			if err != nil {
+				glog.V(2).Infof("Unable to get stats of container %s: %v", name, err)
+				return
+			}
+
+			lock.Lock()
+			if containerStats.NetworkMode == docker.NetworkModeHost {
+				hostNetworkStats = append(hostNetworkStats, containerStats.NetworkStats)
+			}
+			for _, ifindex := range containerStats.Links {
+				veths[ifindex] = container.Name
+			}
+			lock.Unlock()
+			c.cacheStorage.AddStats(container.Name, containerStats)
+		}(name, container)
+	}
+	wg.Wait()
+	c.sysctls.expire()
+	c.conns.expire()
+
+	if hostStats != nil {
+		hostStats.Softnet, err = softnetStatsFromProc(*rootFs)
+		if err != nil {
+			glog.V(2).Infof("Unable to get softnet stats: %v", err)
+		}
+		hostStats.Interfaces, err = hostInterfaceStats(*rootFs, veths)
+		if err != nil {
+			glog.V(2).Infof("Unable to get interface stats of host: %v", err)
+		}
+		c.cacheStorage.UpdateHostStats(storage.HostTarget, hostStats)
+		c.cacheStorage.UpdateHostStats(storage.UnattributedTarget, unattributedStats(hostStats, hostNetworkStats))
+	}
+
+	for _, sink := range c.sinks {
+		sink.Collected()
+	}
+}
+
+// containerStatsFromProc collects the network namespace of the container's init
+// process, then every other namespace entered by a process of its cgroup. When
+// the namespace of the init process is owned by the host or another container,
+// only the sockets of the container are counted in it. ips indexes the
+// containers of the node by ip.
+func (c *collector) containerStatsFromProc(rootFs string, container *docker.ContainerInfo, hostNetns uint64, ips map[string]string) (*docker.ContainerStats, error) {
+	pid := container.Spec.Pid
+	pids := []int{pid}
+	containerStats := &docker.ContainerStats{
+		Timestamp:   time.Now(),
+		NetworkMode: networkMode(container.Spec.NetworkMode),
+	}
+
+	var namespaces map[uint64][]int
+	var allPids []int
+	primary, err := netnsInode(rootFs, pid)
+	if err != nil {
+		glog.V(2).Infof("Unable to get netns of pid %d: %v", pid, err)
+	} else {
+		if hostNetns != 0 && primary == hostNetns {
+			containerStats.NetworkMode = docker.NetworkModeHost
+		}
+
+		cgroupPids, err := cgroupPids(rootFs, container.Name)
+		if err != nil {
+			glog.V(2).Infof("Unable to get pids of container %s: %v", container.Name, err)
+		} else {
+			allPids = cgroupPids
+			namespaces = groupPidsByNetns(rootFs, cgroupPids)
+			if nsPids, ok := namespaces[primary]; ok {
+				pids = nsPids
+			}
+		}
+	}
+
+	var networkStats docker.NetworkStats
+	var sockets []socket
+	if containerStats.SharedNetwork() {
+		inodes := socketInodes(rootFs, pids)
+		networkStats, sockets, err = ownedNetworkStatsFromProc(rootFs, pid, inodes)
+	} else {
+		networkStats, sockets, err = networkStatsFromProc(rootFs, pid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	networkStats.Netns = primary
+	networkStats.Pids = pids
+	containerStats.NetworkStats = networkStats
+
+	if !containerStats.SharedNetwork() {
+		containerStats.Links = interfaceLinks(rootFs, pid)
+		c.netnsWideStatsFromProc(rootFs, pid, primary, sockets, containerStats)
+		setUdpQueueUtilization(&containerStats.NetworkStats, containerStats.Sysctl.RmemDefault)
+	} else if sysctl, err := c.sysctls.get(rootFs, pid, primary); err == nil {
+		setUdpQueueUtilization(&containerStats.NetworkStats, sysctl.RmemDefault)
+	}
+	containerStats.Peers = peerStats(sockets)
+	containerStats.TcpTimers = tcpTimerStats(sockets)
+	containerStats.Churn, containerStats.ConnectionAges = c.conns.update(container.Name, sockets)
+	containerStats.Connections = containerConnections(container.Name, sockets, ips)
+	if c.cluster != nil {
+		resolvePeers(containerStats.Peers.Ips, c.cluster)
+		containerStats.ClusterConnections = clusterConnections(sockets, ips, c.cluster)
+	}
+
+	for inode, nsPids := range namespaces {
+		if inode == primary || inode == hostNetns {
+			continue
+		}
+		nested, _, err := networkStatsFromProc(rootFs, nsPids[0])
+		if err != nil {
+			glog.V(2).Infof("Unable to get stats of netns %d: %v", inode, err)
+			continue
+		}
+		nested.Netns = inode
+		nested.Pids = nsPids
+		if sysctl, err := c.sysctls.get(rootFs, nsPids[0], inode); err == nil {
+			setUdpQueueUtilization(&nested, sysctl.RmemDefault)
+		}
+		containerStats.Nested = append(containerStats.Nested, nested)
+	}
+	sort.Slice(containerStats.Nested, func(i, j int) bool {
+		return containerStats.Nested[i].Netns < containerStats.Nested[j].Netns
+	})
+
+	if *fdAllProcesses && allPids != nil {
+		containerStats.Fds = fdStatsFromProc(rootFs, allPids)
+	} else {
+		containerStats.Fds = fdStatsFromProc(rootFs, []int{pid})
+	}
+
+	return containerStats, nil
+}
+
+// netnsWideStatsFromProc fills the statistics which are only reported by the
+// owner of the network namespace pid lives in, sockets being all its tcp
+// sockets.
+func (c *collector) netnsWideStatsFromProc(rootFs string, pid int, netns uint64, sockets []socket, stats *docker.ContainerStats) {
+	sysctl, err := c.sysctls.get(rootFs, pid, netns)
+	if err != nil {
+		glog.V(2).Infof("Unable to get sysctls from pid %d: %v", pid, err)
+	} else {
+		stats.Sysctl = sysctl
+	}
+
+	if stats.Sysctl.IpLocalPortRangeMax > 0 {
+		stats.EphemeralPorts = ephemeralPortStats(sockets, stats.Sysctl.IpLocalPortRangeMin, stats.Sysctl.IpLocalPortRangeMax)
+	}
+}
+
+// networkMode maps the HostConfig.NetworkMode of a container to host or
+// container for --net=host and --net=container:<id>.
+func networkMode(mode string) string {
+	switch {
+	case mode == docker.NetworkModeHost:
+		return docker.NetworkModeHost
+	case strings.HasPrefix(mode, docker.NetworkModeContainer+":"):
+		return docker.NetworkModeContainer
+	}
+	return mode
+}
+
 func (c *collector) housekeeping(quit chan error) {
 	longHousekeeping := 100 * time.Millisecond
 
@@ -189,61 +353,51 @@ func (c *collector) housekeeping(quit chan error) {
 	}
 }
 
-func tcpStatsFromProc(rootFs string, pid int, file string) (info.TcpStat, error) {
+func tcpStatsFromProc(rootFs string, pid int, file string) (info.TcpStat, types.TcpStatWithPort, error) {
 	tcpStatsFile := path.Join(rootFs, "proc", strconv.Itoa(pid), file)
 
-	tcpStats, err := scanTcpStats(tcpStatsFile)
+	sockets, err := readSockets(tcpStatsFile)
 	if err != nil {
-		return tcpStats, fmt.Errorf("couldn't read tcp stats: %v", err)
+		return info.TcpStat{}, types.TcpStatWithPort{}, fmt.Errorf("couldn't read tcp stats: %v", err)
 	}
 
-	return tcpStats, nil
+	tcpStats, tcpStatsWithPort := tcpSocketStats(sockets)
+	return tcpStats, tcpStatsWithPort, nil
 }
 
-func scanTcpStats(tcpStatsFile string) (info.TcpStat, error) {
-	var stats info.TcpStat
-
-	data, err := ioutil.ReadFile(tcpStatsFile)
-	if err != nil {
-		return stats, fmt.Errorf("failure opening %s: %v", tcpStatsFile, err)
+// tcpSocketStats counts the sockets by state, and by listening port for the
+// sockets with a listening local port.
+func tcpSocketStats(sockets []socket) (info.TcpStat, types.TcpStatWithPort) {
+	tcpStateMap := make(map[string]uint64)
+	listening := make(map[uint16]bool)
+	for _, s := range sockets {
+		tcpStateMap[s.state]++
+		if s.state == tcpListen {
+			listening[s.localPort] = true
+		}
 	}
 
-	tcpStateMap := map[string]uint64{
-		"01": 0, //ESTABLISHED
-		"02": 0, //SYN_SENT
-		"03": 0, //SYN_RECV
-		"04": 0, //FIN_WAIT1
-		"05": 0, //FIN_WAIT2
-		"06": 0, //TIME_WAIT
-		"07": 0, //CLOSE
-		"08": 0, //CLOSE_WAIT
-		"09": 0, //LAST_ACK
-		"0A": 0, //LISTEN
-		"0B": 0, //CLOSING
+	portStateMaps := make(map[int64]map[string]uint64, len(listening))
+	for _, s := range sockets {
+		if !listening[s.localPort] {
+			continue
+		}
+		port := int64(s.localPort)
+		if portStateMaps[port] == nil {
+			portStateMaps[port] = make(map[string]uint64)
+		}
+		portStateMaps[port][s.state]++
 	}
-
-	reader := strings.NewReader(string(data))
-	scanner := bufio.NewScanner(reader)
-
-	scanner.Split(bufio.ScanLines)
-
-	if b := scanner.Scan(); !b {
-		return stats, scanner.Err()
+	statsWithPort := types.TcpStatWithPort{Stats: make(map[int64]info.TcpStat, len(portStateMaps))}
+	for port, stateMap := range portStateMaps {
+		statsWithPort.Stats[port] = newTcpStat(stateMap)
 	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		state := strings.Fields(line)
-		tcpState := state[3]
-		_, ok := tcpStateMap[tcpState]
-		if !ok {
-			return stats, fmt.Errorf("invalid TCP stats line: %v", line)
-		}
-		tcpStateMap[tcpState]++
-	}
+	return newTcpStat(tcpStateMap), statsWithPort
+}
 
-	stats = info.TcpStat{
+func newTcpStat(tcpStateMap map[string]uint64) info.TcpStat {
+	return info.TcpStat{
 		Established: tcpStateMap["01"],
 		SynSent:     tcpStateMap["02"],
 		SynRecv:     tcpStateMap["03"],
@@ -256,37 +410,41 @@ func scanTcpStats(tcpStatsFile string) (info.TcpStat, error) {
 		Listen:      tcpStateMap["0A"],
 		Closing:     tcpStateMap["0B"],
 	}
-
-	return stats, nil
 }
 
-func udpStatsFromProc(rootFs string, pid int, file string) (info.UdpStat, error) {
+func udpStatsFromProc(rootFs string, pid int, file string) (info.UdpStat, types.UdpStatWithPort, error) {
 	var err error
 	var udpStats info.UdpStat
+	var udpStatsWithPort types.UdpStatWithPort
 
 	udpStatsFile := path.Join(rootFs, "proc", strconv.Itoa(pid), file)
 
 	r, err := os.Open(udpStatsFile)
 	if err != nil {
-		return udpStats, fmt.Errorf("failure opening %s: %v", udpStatsFile, err)
+		return udpStats, udpStatsWithPort, fmt.Errorf("failure opening %s: %v", udpStatsFile, err)
 	}
+	defer r.Close()
 
-	udpStats, err = scanUdpStats(r)
+	udpStats, udpStatsWithPort, err = scanUdpStats(r, nil)
 	if err != nil {
-		return udpStats, fmt.Errorf("couldn't read udp stats: %v", err)
+		return udpStats, udpStatsWithPort, fmt.Errorf("couldn't read udp stats: %v", err)
 	}
 
-	return udpStats, nil
+	return udpStats, udpStatsWithPort, nil
 }
 
-func scanUdpStats(r io.Reader) (info.UdpStat, error) {
+// scanUdpStats sums the sockets read from r, and the unconnected ones by
+// local port as they are the receivers such as dns or statsd servers. When
+// inodes is not nil, only the sockets with one of those inodes are summed.
+func scanUdpStats(r io.Reader, inodes map[uint64]struct{}) (info.UdpStat, types.UdpStatWithPort, error) {
 	var stats info.UdpStat
+	statsWithPort := types.UdpStatWithPort{Stats: make(map[int64]types.UdpPortStat)}
 
 	scanner := bufio.NewScanner(r)
 	scanner.Split(bufio.ScanLines)
 
 	if b := scanner.Scan(); !b {
-		return stats, scanner.Err()
+		return stats, statsWithPort, scanner.Err()
 	}
 
 	listening := uint64(0)
@@ -297,15 +455,20 @@ func scanUdpStats(r io.Reader) (info.UdpStat, error) {
 	for scanner.Scan() {
 		line := scanner.Text()
 
+		fs := strings.Fields(line)
+		if inodes != nil && !socketOwned(fs, inodes) {
+			continue
+		}
+
 		listening++
 
-		fs := strings.Fields(line)
 		if len(fs) != 13 {
 			continue
 		}
 
 		rx, tx := uint64(0), uint64(0)
-		fmt.Sscanf(fs[4], "%X:%X", &rx, &tx)
+		// tx_queue:rx_queue
+		fmt.Sscanf(fs[4], "%X:%X", &tx, &rx)
 		rxQueued += rx
 		txQueued += tx
 
@@ -314,6 +477,24 @@ func scanUdpStats(r io.Reader) (info.UdpStat, error) {
 			continue
 		}
 		dropped += uint64(d)
+
+		_, localPort, err := parseSocketAddr(fs[1])
+		if err != nil {
+			continue
+		}
+		_, remotePort, err := parseSocketAddr(fs[2])
+		if err != nil || remotePort != 0 {
+			continue
+		}
+		portStats := statsWithPort.Stats[int64(localPort)]
+		portStats.Sockets++
+		portStats.Dropped += uint64(d)
+		portStats.RxQueued += rx
+		portStats.TxQueued += tx
+		if rx > portStats.MaxRxQueued {
+			portStats.MaxRxQueued = rx
+		}
+		statsWithPort.Stats[int64(localPort)] = portStats
 	}
 
 	stats = info.UdpStat{
@@ -323,7 +504,21 @@ func scanUdpStats(r io.Reader) (info.UdpStat, error) {
 		TxQueued: txQueued,
 	}
 
-	return stats, nil
+	return stats, statsWithPort, nil
+}
+
+// setUdpQueueUtilization sets the rx queue utilization of udp ports, the
+// receive buffer of sockets being rmemDefault unless set by SO_RCVBUF.
+func setUdpQueueUtilization(stats *docker.NetworkStats, rmemDefault uint64) {
+	if rmemDefault == 0 {
+		return
+	}
+	for _, statsWithPort := range []types.UdpStatWithPort{stats.UdpWithPort, stats.Udp6WithPort} {
+		for port, portStats := range statsWithPort.Stats {
+			portStats.RxQueueUtilization = float64(portStats.MaxRxQueued) / float64(rmemDefault)
+			statsWithPort.Stats[port] = portStats
+		}
+	}
 }
 
 func scanTcpExtStats(rootFs string, pid int, file string) (types.TcpExtStat, error) {
@@ -1,12 +1,19 @@
 package collector
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/yanqing-exporter/collector/types"
+	"github.com/yanqing-exporter/container/docker"
 )
 
 const TcpExtStatContent = `TcpExt: SyncookiesSent SyncookiesRecv SyncookiesFailed EmbryonicRsts PruneCalled RcvPruned OfoPruned OutOfWindowIcmps LockDroppedIcmps ArpFilter TW TWRecycled TWKilled PAWSPassive PAWSActive PAWSEstab DelayedACKs DelayedACKLocked DelayedACKLost ListenOverflows ListenDrops TCPPrequeued TCPDirectCopyFromBacklog TCPDirectCopyFromPrequeue TCPPrequeueDropped TCPHPHits TCPHPHitsToUser TCPPureAcks TCPHPAcks TCPRenoRecovery TCPSackRecovery TCPSACKReneging TCPFACKReorder TCPSACKReorder TCPRenoReorder TCPTSReorder TCPFullUndo TCPPartialUndo TCPDSACKUndo TCPLossUndo TCPLostRetransmit TCPRenoFailures TCPSackFailures TCPLossFailures TCPFastRetrans TCPForwardRetrans TCPSlowStartRetrans TCPTimeouts TCPLossProbes TCPLossProbeRecovery TCPRenoRecoveryFail TCPSackRecoveryFail TCPSchedulerFailed TCPRcvCollapsed TCPDSACKOldSent TCPDSACKOfoSent TCPDSACKRecv TCPDSACKOfoRecv TCPAbortOnData TCPAbortOnClose TCPAbortOnMemory TCPAbortOnTimeout TCPAbortOnLinger TCPAbortFailed TCPMemoryPressures TCPSACKDiscard TCPDSACKIgnoredOld TCPDSACKIgnoredNoUndo TCPSpuriousRTOs TCPMD5NotFound TCPMD5Unexpected TCPSackShifted TCPSackMerged TCPSackShiftFallback TCPBacklogDrop TCPMinTTLDrop TCPDeferAcceptDrop IPReversePathFilter TCPTimeWaitOverflow TCPReqQFullDoCookies TCPReqQFullDrop TCPRetransFail TCPRcvCoalesce TCPOFOQueue TCPOFODrop TCPOFOMerge TCPChallengeACK TCPSYNChallenge TCPFastOpenActive TCPFastOpenPassive TCPFastOpenPassiveFail TCPFastOpenListenOverflow TCPFastOpenCookieReqd TCPSpuriousRtxHostQueues BusyPollRxPackets
@@ -96,3 +103,853 @@ func TestTcpStatCollect(t *testing.T) {
 		fmt.Println(stats.Established)
 	}
 }
+
+func TestUdpStatQueues(t *testing.T) {
+	content := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  120: 00000000:0035 00000000:0000 07 00000200:00034000 00:00000000 00000000     0        0 20394 2 ffff88e3eb1c8000 12
+`
+	stats, _, err := scanUdpStats(strings.NewReader(content), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TxQueued != 0x200 || stats.RxQueued != 0x34000 || stats.Dropped != 12 {
+		t.Errorf("expected 0x200 bytes queued for tx and 0x34000 for rx, got %+v", stats)
+	}
+}
+
+const SctpAssocsContent = ` ASSOC     SOCK   STY SST ST HBKT ASSOC-ID TX_QUEUE RX_QUEUE UID INODE LPORT RPORT LADDRS <-> RADDRS HBINT INS OUTS MAXRT T1X T2X RTXC wmema wmemq sndbuf rcvbuf
+ffff8803e2b3c000 ffff8803e2f0b000 2   1   3  0       3        0        0       0 37011 36412  2905  10.0.0.1 <-> *10.0.0.2 	    7500    10    10   10    0    0        0        1        0   212992   212992
+ffff8803e2b3d000 ffff8803e2f0b800 2   1   3  0       4        0        0       0 37012 36412  2906  10.0.0.1 <-> *10.0.0.3 	    7500    10    10   10    0    0        0        1        0   212992   212992
+ffff8803e2b3e000 ffff8803e2f0c000 2   2   1  0       5        0        0       0 37013 36413  2907  10.0.0.1 <-> *10.0.0.4 	    7500    10    10   10    0    0        0        1        0   212992   212992`
+
+const SctpEpsContent = ` ENDPT     SOCK   STY SST HBKT LPORT   UID INODE LADDRS
+ffff8803e2f0a000 ffff8803e2f0a000 2   10  29   36412     0 37010 10.0.0.1
+ffff8803e2f0a800 ffff8803e2f0a800 2   10  30   36413     0 37014 10.0.0.1`
+
+const SctpSnmpContent = `SctpCurrEstab                   	2
+SctpActiveEstabs                	3
+SctpPassiveEstabs               	0
+SctpAborteds                    	7
+SctpShutdowns                   	1
+SctpOutOfBlues                  	0
+SctpChecksumErrors              	4
+SctpT3RtxExpireds               	12`
+
+func TestSctpStatCollect(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// no sctp module loaded
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/"), 0755)
+	sctpStat, sctpSnmpStat, err := sctpStatsFromProc(yqStatDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sctpStat.Established != 0 || sctpSnmpStat.SctpAborteds != 0 {
+		t.Errorf("expected empty sctp stats, got %v %v", sctpStat, sctpSnmpStat)
+	}
+
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/sctp/"), 0755)
+	files := map[string]string{
+		"assocs": SctpAssocsContent,
+		"eps":    SctpEpsContent,
+		"snmp":   SctpSnmpContent,
+	}
+	for file, content := range files {
+		if err = ioutil.WriteFile(path.Join(yqStatDir, "/proc/1/net/sctp/", file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sctpStat, sctpSnmpStat, err = sctpStatsFromProc(yqStatDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sctpStat.Established != 2 || sctpStat.CookieWait != 1 || sctpStat.Endpoints != 2 {
+		t.Errorf("unexpected sctp stats %v", sctpStat)
+	}
+	if sctpSnmpStat.SctpCurrEstab != 2 || sctpSnmpStat.SctpAborteds != 7 || sctpSnmpStat.SctpChecksumErrors != 4 || sctpSnmpStat.SctpT3RtxExpireds != 12 {
+		t.Errorf("unexpected sctp snmp stats %v", sctpSnmpStat)
+	}
+}
+
+func TestNetworkStatsOptionalTables(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/sctp/"), 0755)
+	for file, content := range map[string]string{
+		"tcp":         TcpStatContent,
+		"tcp6":        TcpStatContent,
+		"udp":         UdpStatContent,
+		"udp6":        UdpStatContent,
+		"netstat":     TcpExtStatContent,
+		"route":       RouteContent,
+		"ipv6_route":  "invalid",
+		"sctp/assocs": SctpAssocsContent,
+		"icmp":        RawStatContent,
+	} {
+		if err = ioutil.WriteFile(path.Join(yqStatDir, "/proc/1/net/", file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sctp/eps and arp are missing, raw can not be read and ipv6_route is
+	// invalid
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/raw"), 0755)
+	stats, _, err := networkStatsFromProc(yqStatDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Tcp.Established == 0 || stats.Sctp.Established != 0 {
+		t.Errorf("expected the tcp stats to be kept without sctp stats, got %+v %+v", stats.Tcp, stats.Sctp)
+	}
+	if stats.Raw.Listen != 0 || stats.Icmp.Listen != 1 {
+		t.Errorf("expected only the valid datagram stats, got raw %+v and icmp %+v", stats.Raw, stats.Icmp)
+	}
+	if len(stats.Neighbors.Neighbors) != 0 || stats.Routes.Routes != 0 {
+		t.Errorf("expected no neighbor and route stats, got %+v %+v", stats.Neighbors, stats.Routes)
+	}
+}
+
+func TestEphemeralPortStats(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/"), 0755)
+	tcpStatFile := path.Join(yqStatDir, "/proc/1/net/tcp")
+	if err = ioutil.WriteFile(tcpStatFile, []byte(TcpStatContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// inbound connections to a listening port within the range
+	tcp6StatContent := strings.SplitN(TcpStatContent, "\n", 2)[0] + `
+   0: 00000000000000000000000000000000:80E8 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 200001 1 ffff88e34d17b800 100 0 0 10 0
+   1: 0000000000000000FFFF0000FC1E16AC:80E8 0000000000000000FFFF00002380000A:1F90 01 00000000:00000000 00:00000000 00000000     0        0 200002 1 ffff88e34d17b800 20 4 0 10 -1
+   2: 0000000000000000FFFF0000FC1E16AC:80E8 0000000000000000FFFF00002380000A:1F90 01 00000000:00000000 00:00000000 00000000     0        0 200003 1 ffff88e34d17b800 20 4 0 10 -1`
+	tcp6StatFile := path.Join(yqStatDir, "/proc/1/net/tcp6")
+	if err = ioutil.WriteFile(tcp6StatFile, []byte(tcp6StatContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tcpSockets, tcp6Sockets, err := tcpSocketsFromProc(yqStatDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockets := append(tcpSockets, tcp6Sockets...)
+	if len(sockets) != 26 {
+		t.Fatalf("expected 26 sockets, got %d", len(sockets))
+	}
+	if s := sockets[1]; s.localIp.String() != "172.22.30.252" || s.localPort != 60726 || s.remoteIp.String() != "10.0.32.248" || s.remotePort != 80 {
+		t.Errorf("unexpected socket %+v", s)
+	}
+
+	stats := ephemeralPortStats(sockets, 32768, 60999)
+	if stats.Available != 28232 || stats.MaxUsed != 16 {
+		t.Errorf("unexpected ephemeral port stats %+v", stats)
+	}
+	if len(stats.Top) != 2 || stats.Top[0].RemoteIp != "10.0.32.248" || stats.Top[0].RemotePort != 80 || stats.Top[1].Used != 1 {
+		t.Errorf("unexpected top destinations %+v", stats.Top)
+	}
+}
+
+func TestParseSocketAddr(t *testing.T) {
+	ip, port, err := parseSocketAddr("0000000000000000FFFF00000100007F:1F90")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "127.0.0.1" || port != 8080 {
+		t.Errorf("unexpected address %v:%d", ip, port)
+	}
+
+	ip, port, err = parseSocketAddr("B80D01200000000067452301EFCDAB89:0050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "2001:db8::123:4567:89ab:cdef" || port != 80 {
+		t.Errorf("unexpected address %v:%d", ip, port)
+	}
+
+	if _, _, err = parseSocketAddr("0100007F"); err == nil {
+		t.Errorf("expected an error for an address without port")
+	}
+}
+
+func TestPeerStats(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/"), 0755)
+	tcpStatFile := path.Join(yqStatDir, "/proc/1/net/tcp")
+	if err = ioutil.WriteFile(tcpStatFile, []byte(TcpStatContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sockets, err := readSockets(tcpStatFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := peerStats(sockets)
+	if len(stats.Ips) != 5 {
+		t.Fatalf("expected 5 remote ips, got %+v", stats.Ips)
+	}
+	if peer := stats.Ips[0]; peer.Ip != "10.0.32.248" || peer.Total != 16 || peer.States["established"] != 16 {
+		t.Errorf("unexpected top remote ip %+v", peer)
+	}
+	if peer := stats.Ports[0]; peer.Port != 80 || peer.Total != 16 {
+		t.Errorf("unexpected top remote port %+v", peer)
+	}
+}
+
+func TestContainerConnections(t *testing.T) {
+	ips := map[string]string{
+		"10.0.32.248": "/docker/backend",
+		"10.0.0.1":    "/docker/frontend",
+	}
+	sockets := []socket{
+		{remoteIp: net.ParseIP("10.0.32.248"), state: "01"},
+		{remoteIp: net.ParseIP("10.0.32.248"), state: "01"},
+		{remoteIp: net.ParseIP("10.0.32.248"), state: "06"},
+		{remoteIp: net.ParseIP("10.0.0.1"), state: "01"},
+		{remoteIp: net.ParseIP("10.0.0.2"), state: "01"},
+		{remoteIp: net.ParseIP("10.0.32.248"), state: tcpListen},
+	}
+
+	connections := containerConnections("/docker/frontend", sockets, ips)
+	if len(connections) != 1 {
+		t.Fatalf("expected connections with 1 container, got %+v", connections)
+	}
+	if c := connections[0]; c.Container != "/docker/backend" || c.States["established"] != 2 || c.States["timewait"] != 1 {
+		t.Errorf("unexpected connections %+v", c)
+	}
+}
+
+func TestConnTrackerChurn(t *testing.T) {
+	listen := socket{localIp: net.ParseIP("10.0.0.1"), localPort: 80, remoteIp: net.IPv4zero, state: tcpListen, inode: 1}
+	inbound := socket{localIp: net.ParseIP("10.0.0.1"), localPort: 80, remoteIp: net.ParseIP("10.0.0.2"), remotePort: 40000, state: "01", inode: 2}
+	outbound := socket{localIp: net.ParseIP("10.0.0.1"), localPort: 50000, remoteIp: net.ParseIP("10.0.0.3"), remotePort: 5432, state: "01", inode: 3}
+	reused := outbound
+	reused.inode = 4
+	shortLived := socket{localIp: net.ParseIP("10.0.0.1"), localPort: 50001, remoteIp: net.ParseIP("10.0.0.3"), remotePort: 5432, state: tcpTimeWait}
+
+	tracker := newConnTracker()
+	churn, _ := tracker.update("/docker/test", []socket{listen, inbound})
+	if churn.Interval != (types.ChurnStat{}) {
+		t.Errorf("expected no churn on the first collection, got %+v", churn.Interval)
+	}
+
+	churn, _ = tracker.update("/docker/test", []socket{listen, outbound, shortLived})
+	expected := types.ChurnStat{InboundClosed: 1, OutboundOpened: 2, OutboundClosed: 1}
+	if churn.Interval != expected {
+		t.Errorf("expected churn %+v, got %+v", expected, churn.Interval)
+	}
+
+	churn, _ = tracker.update("/docker/test", []socket{listen, reused, shortLived})
+	expected = types.ChurnStat{OutboundOpened: 1, OutboundClosed: 1}
+	if churn.Interval != expected {
+		t.Errorf("expected churn %+v, got %+v", expected, churn.Interval)
+	}
+	expected = types.ChurnStat{InboundClosed: 1, OutboundOpened: 3, OutboundClosed: 2}
+	if churn.Total != expected {
+		t.Errorf("expected total churn %+v, got %+v", expected, churn.Total)
+	}
+}
+
+func TestConnTrackerLocalClose(t *testing.T) {
+	established := socket{localIp: net.ParseIP("10.0.0.1"), localPort: 50000, remoteIp: net.ParseIP("10.0.0.3"), remotePort: 5432, state: "01", inode: 5}
+	// the socket closed by the application is orphaned and loses its inode
+	finWait := established
+	finWait.state, finWait.inode = "04", 0
+	timeWait := established
+	timeWait.state, timeWait.inode = tcpTimeWait, 0
+
+	tracker := newConnTracker()
+	tracker.update("/docker/test", nil)
+	var churn *types.ConnectionChurnStat
+	for _, sockets := range [][]socket{{established}, {finWait}, {timeWait}, nil} {
+		churn, _ = tracker.update("/docker/test", sockets)
+	}
+	expected := types.ChurnStat{OutboundOpened: 1, OutboundClosed: 1}
+	if churn.Total != expected {
+		t.Errorf("expected total churn %+v, got %+v", expected, churn.Total)
+	}
+}
+
+func TestConnectionAgeStat(t *testing.T) {
+	stat := connectionAgeStat("closewait", []float64{5, 120, 7200})
+	if stat.Count != 3 || stat.Sum != 7325 || stat.Max != 7200 {
+		t.Errorf("unexpected connection age stat %+v", stat)
+	}
+	var expected []types.AgeBucket
+	for i, count := range []uint64{1, 1, 2, 2, 2, 3, 3, 3} {
+		expected = append(expected, types.AgeBucket{UpperBound: connectionAgeBuckets[i], Count: count})
+	}
+	if !reflect.DeepEqual(stat.Buckets, expected) {
+		t.Errorf("expected buckets %v, got %v", expected, stat.Buckets)
+	}
+	if _, err := json.Marshal(stat); err != nil {
+		t.Errorf("connection age stat is not serializable: %v", err)
+	}
+
+	tracker := newConnTracker()
+	closeWait := socket{localIp: net.ParseIP("10.0.0.1"), localPort: 50000, remoteIp: net.ParseIP("10.0.0.3"), remotePort: 5432, state: "08", inode: 3}
+	_, ages := tracker.update("/docker/test", []socket{closeWait})
+	if len(ages) != 2 || ages[0].State != "established" || ages[0].Count != 0 || ages[1].State != "closewait" || ages[1].Count != 1 {
+		t.Errorf("unexpected connection ages %+v", ages)
+	}
+}
+
+const TcpTimerStatContent = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 157345035 1 ffff88e34d17b800 100 0 0 10 0
+   1: FC1E16AC:ED36 F820000A:0050 01 00000000:00000000 02:0000003A 00000000  1000        0 157952987 2 ffff88e84ba91000 22 4 16 10 -1
+   2: FC1E16AC:8390 0B20000A:0050 01 00001A2C:00000000 01:000001F4 0000000C  1000        0 157963826 2 ffff88ec6efc9800 21 4 28 10 -1
+   3: FC1E16AC:8392 0B20000A:0050 01 00001A2C:00000000 01:000000C8 00000003  1000        0 157963827 2 ffff88ec6efc9800 21 4 28 10 -1
+   4: FC1E16AC:0050 2380000A:8F43 01 00000A00:00000000 04:00000FA0 00000000 65534        0 159220417 1 ffff88e969041000 20 4 0 29 25
+   5: 0100007F:C62C 0100007F:1F90 06 00000000:00000000 03:0000142F 00000000     0        0 0 3 ffff88e880212ee0
+`
+
+func TestTcpTimerStats(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/"), 0755)
+	tcpStatFile := path.Join(yqStatDir, "/proc/1/net/tcp")
+	if err = ioutil.WriteFile(tcpStatFile, []byte(TcpTimerStatContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sockets, err := readSockets(tcpStatFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := tcpTimerStats(sockets)
+	expected := types.TcpTimerStat{
+		Retransmit:         2,
+		ZeroWindowProbe:    1,
+		Keepalive:          1,
+		MaxRetransmits:     12,
+		MaxRetransmitsPeer: "10.0.32.11",
+	}
+	if stats != expected {
+		t.Errorf("expected tcp timer stats %+v, got %+v", expected, stats)
+	}
+}
+
+const UdpStatContent = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  120: 00000000:0035 00000000:0000 07 00000000:00034000 00:00000000 00000000     0        0 20394 2 ffff88e3eb1c8000 1520
+  121: 0100007F:0035 00000000:0000 07 00000000:00001000 00:00000000 00000000     0        0 20395 2 ffff88e3eb1c8400 3
+  210: 00000000:1F9D 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 20396 2 ffff88e3eb1c8800 0
+  305: FC1E16AC:C5A0 0A00000A:0035 01 00000000:00000000 00:00000000 00000000     0        0 20397 2 ffff88e3eb1c8c00 7
+`
+
+func TestUdpStatWithPort(t *testing.T) {
+	stats, statsWithPort, err := scanUdpStats(strings.NewReader(UdpStatContent), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Listen != 4 || stats.Dropped != 1530 {
+		t.Errorf("unexpected udp stats %+v", stats)
+	}
+	if len(statsWithPort.Stats) != 2 {
+		t.Fatalf("expected the unconnected sockets of 2 ports, got %+v", statsWithPort.Stats)
+	}
+	dns := statsWithPort.Stats[53]
+	if dns.Sockets != 2 || dns.Dropped != 1523 || dns.RxQueued != 0x35000 || dns.MaxRxQueued != 0x34000 {
+		t.Errorf("unexpected udp stats of port 53 %+v", dns)
+	}
+
+	networkStats := docker.NetworkStats{UdpWithPort: statsWithPort}
+	setUdpQueueUtilization(&networkStats, 0x68000)
+	if utilization := networkStats.UdpWithPort.Stats[53].RxQueueUtilization; utilization != 0.5 {
+		t.Errorf("expected rx queue utilization of port 53 to be 0.5, got %v", utilization)
+	}
+}
+
+const RawStatContent = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+    1: 00000000:0001 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 31245 2 ffff88e3eb1c9000 12
+`
+
+func TestDatagramStatCollect(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/"), 0755)
+	if err = ioutil.WriteFile(path.Join(yqStatDir, "/proc/1/net/raw"), []byte(RawStatContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rawStat, err := datagramStatsFromProc(yqStatDir, 1, "net/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawStat.Listen != 1 || rawStat.Dropped != 12 {
+		t.Errorf("unexpected raw stats %+v", rawStat)
+	}
+
+	icmp6Stat, err := datagramStatsFromProc(yqStatDir, 1, "net/icmp6")
+	if err != nil {
+		t.Errorf("expected a missing icmp6 table to be ignored, got %v", err)
+	}
+	if icmp6Stat.Listen != 0 {
+		t.Errorf("unexpected icmp6 stats %+v", icmp6Stat)
+	}
+}
+
+const IpvsContent = `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP  0A600001:01BB rr
+  -> 0AF40103:192B      Masq    1      3          1
+  -> 0AF40207:192B      Masq    1      2          0
+UDP  0A60000A:0035 rr
+  -> 0AF40002:0035      Masq    1      0          0
+FWM  00000001 rr
+TCP  [fd00:0000:0000:0000:0000:0000:0000:0001]:0050 rr
+  -> [fd00:0000:0000:0000:0000:0000:0001:0002]:1F90      Masq    1      1          0
+`
+
+const IpvsStatsContent = `   Total Incoming Outgoing         Incoming         Outgoing
+   Conns  Packets  Packets            Bytes            Bytes
+     1FE       8C        0             2CA0                0
+
+ Conns/s   Pkts/s   Pkts/s          Bytes/s          Bytes/s
+       0        0        0                0                0
+`
+
+const IpvsConnContent = `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+TCP 0A000101 D8A6 0A600001 01BB 0AF40103 192B ESTABLISHED    899
+TCP 0A000101 D8A8 0A600001 01BB 0AF40207 192B ESTABLISHED    899
+TCP 0A000102 D8A6 0A600001 01BB 0AF40103 192B TIME_WAIT      100
+UDP 0A000101 9F30 0A60000A 0035 0AF40002 0035 UDP            200
+`
+
+func TestIpvsStatCollect(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/"), 0755)
+
+	stats, err := ipvsStatsFromProc(yqStatDir, nil)
+	if err != nil || stats != nil {
+		t.Errorf("expected no ipvs stats without ipvs, got %+v %v", stats, err)
+	}
+
+	for file, content := range map[string]string{
+		"ip_vs":       IpvsContent,
+		"ip_vs_stats": IpvsStatsContent,
+		"ip_vs_conn":  IpvsConnContent,
+	} {
+		if err = ioutil.WriteFile(path.Join(yqStatDir, "/proc/1/net/", file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err = ipvsStatsFromProc(yqStatDir, map[string]string{"10.244.1.3": "/docker/backend"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Connections != 0x1FE || stats.IncomingPackets != 0x8C || stats.IncomingBytes != 0x2CA0 {
+		t.Errorf("unexpected ipvs stats %+v", stats)
+	}
+	if len(stats.Services) != 4 {
+		t.Fatalf("expected 4 virtual services, got %+v", stats.Services)
+	}
+
+	service := stats.Services[0]
+	if service.Protocol != "tcp" || service.Address != "10.96.0.1" || service.Port != 443 || len(service.Backends) != 2 {
+		t.Errorf("unexpected virtual service %+v", service)
+	}
+	if service.States["established"] != 2 || service.States["time_wait"] != 1 {
+		t.Errorf("unexpected virtual service connections %+v", service.States)
+	}
+	backend := service.Backends[0]
+	if backend.Address != "10.244.1.3" || backend.Port != 6443 || backend.ActiveConn != 3 || backend.InactiveConn != 1 || backend.Container != "/docker/backend" {
+		t.Errorf("unexpected real server %+v", backend)
+	}
+	if service := stats.Services[2]; service.Protocol != "fwm" || service.Address != "1" {
+		t.Errorf("unexpected fwm virtual service %+v", service)
+	}
+	if service := stats.Services[3]; service.Address != "fd00::1" || service.Port != 80 || service.Backends[0].Address != "fd00::1:2" {
+		t.Errorf("unexpected ipv6 virtual service %+v", service)
+	}
+}
+
+const ArpContent = `IP address       HW type     Flags       HW address            Mask     Device
+10.244.1.1       0x1         0x2         0a:58:0a:f4:01:01     *        eth0
+10.244.1.7       0x1         0x0         00:00:00:00:00:00     *        eth0
+10.244.1.9       0x1         0x6         0a:58:0a:f4:01:09     *        eth0
+`
+
+const RouteContent = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0101F40A	0003	0	0	0	00000000	0	0	0
+eth0	0001F40A	00000000	0001	0	0	0	00FFFFFF	0	0	0
+`
+
+const Ipv6RouteContent = `fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo
+`
+
+func TestNeighborAndRouteStatCollect(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/"), 0755)
+	for file, content := range map[string]string{
+		"arp":        ArpContent,
+		"route":      RouteContent,
+		"ipv6_route": Ipv6RouteContent,
+	} {
+		if err = ioutil.WriteFile(path.Join(yqStatDir, "/proc/1/net/", file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	neighbors, err := neighborStatsFromProc(yqStatDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []types.NeighborCount{
+		{Interface: "eth0", State: "complete", Count: 1},
+		{Interface: "eth0", State: "incomplete", Count: 1},
+		{Interface: "eth0", State: "permanent", Count: 1},
+	}
+	if fmt.Sprint(neighbors.Neighbors) != fmt.Sprint(expected) {
+		t.Errorf("expected neighbors %v, got %v", expected, neighbors.Neighbors)
+	}
+
+	routes, err := routeStatsFromProc(yqStatDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unreachable ipv6 route of the loopback is not a default route
+	expectedRoutes := types.RouteStat{Routes: 2, DefaultRoute: true, Ipv6: true, Routes6: 1}
+	if routes != expectedRoutes {
+		t.Errorf("expected routes %+v, got %+v", expectedRoutes, routes)
+	}
+}
+
+const SoftnetStatContent = `0002a8c5 00000000 00000012 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000
+0001f3b0 0000000a 00000003 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000002
+`
+
+const NetDevContent = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:  123456     789    0    0    0     0          0         0   123456     789    0    0    0     0       0          0
+  eth0: 9876543   54321    1   12    0     0          0         0  1234567   43210    0    3    0     0       0          0
+vethab12cd:  4567     89    0    7    0     0          0         0     8910     111    0    2    0     0       0          0
+`
+
+func TestHostInterfaceStats(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	os.MkdirAll(path.Join(yqStatDir, "/proc/1/net/"), 0755)
+	os.MkdirAll(path.Join(yqStatDir, "/proc/100/net/"), 0755)
+	files := map[string]string{
+		"/proc/1/net/softnet_stat":                        SoftnetStatContent,
+		"/proc/1/net/dev":                                 NetDevContent,
+		"/sys/class/net/vethab12cd/ifindex":               "27\n",
+		"/sys/class/net/vethab12cd/iflink":                "3\n",
+		"/proc/100/net/dev":                               NetDevContent,
+		"/proc/100/root/sys/class/net/eth0/ifindex":       "3\n",
+		"/proc/100/root/sys/class/net/eth0/iflink":        "27\n",
+		"/proc/100/root/sys/class/net/lo/ifindex":         "1\n",
+		"/proc/100/root/sys/class/net/lo/iflink":          "1\n",
+		"/proc/100/root/sys/class/net/vethab12cd/ifindex": "5\n",
+	}
+	for file, content := range files {
+		os.MkdirAll(path.Dir(path.Join(yqStatDir, file)), 0755)
+		if err = ioutil.WriteFile(path.Join(yqStatDir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	softnet, err := softnetStatsFromProc(yqStatDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSoftnet := []types.SoftnetStat{
+		{Cpu: 0, Processed: 0x2a8c5, TimeSqueeze: 0x12},
+		{Cpu: 2, Processed: 0x1f3b0, Dropped: 0xa, TimeSqueeze: 3},
+	}
+	if fmt.Sprint(softnet) != fmt.Sprint(expectedSoftnet) {
+		t.Errorf("expected softnet stats %v, got %v", expectedSoftnet, softnet)
+	}
+
+	links := interfaceLinks(yqStatDir, 100)
+	if len(links) != 1 || links["eth0"] != 27 {
+		t.Errorf("expected eth0 to link to ifindex 27, got %v", links)
+	}
+
+	interfaces, err := hostInterfaceStats(yqStatDir, map[int]string{27: "/docker/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interfaces) != 3 {
+		t.Fatalf("expected 3 interfaces, got %+v", interfaces)
+	}
+	if eth0 := interfaces[1]; eth0.Name != "eth0" || eth0.RxDropped != 12 || eth0.TxDropped != 3 || eth0.RxErrors != 1 || eth0.Container != "" {
+		t.Errorf("unexpected eth0 stats %+v", eth0)
+	}
+	if veth := interfaces[2]; veth.Name != "vethab12cd" || veth.RxDropped != 7 || veth.TxDropped != 2 || veth.Container != "/docker/test" {
+		t.Errorf("unexpected veth stats %+v", veth)
+	}
+}
+
+const LimitsContent = `Limit                     Soft Limit           Hard Limit           Units
+Max cpu time              unlimited            unlimited            seconds
+Max file size             unlimited            unlimited            bytes
+Max processes             unlimited            unlimited            processes
+Max open files            1048576              1048576              files
+Max locked memory         65536                65536                bytes
+`
+
+func TestFdStats(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	processes := map[int]struct {
+		limits string
+		fds    []string
+	}{
+		100: {LimitsContent, []string{"/dev/null", "socket:[1234]", "socket:[1235]", "pipe:[2000]", "anon_inode:[eventpoll]"}},
+		101: {strings.Replace(LimitsContent, "1048576", "4       ", 1), []string{"/dev/null", "/var/log/app.log", "pipe:[2001]"}},
+		102: {strings.Replace(LimitsContent, "1048576", "unlimited", 1), []string{"socket:[1236]"}},
+	}
+	for pid, p := range processes {
+		procDir := path.Join(yqStatDir, "proc", strconv.Itoa(pid))
+		os.MkdirAll(path.Join(procDir, "fd"), 0755)
+		if err = ioutil.WriteFile(path.Join(procDir, "limits"), []byte(p.limits), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for fd, link := range p.fds {
+			if err = os.Symlink(link, path.Join(procDir, "fd", strconv.Itoa(fd))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 103 has exited
+	stats := fdStatsFromProc(yqStatDir, []int{100, 101, 102, 103})
+	expected := types.FdStat{
+		Processes:      3,
+		Sockets:        3,
+		Pipes:          2,
+		AnonInodes:     1,
+		Files:          3,
+		MaxPid:         101,
+		MaxOpen:        3,
+		MaxLimit:       4,
+		MaxUtilization: 0.75,
+	}
+	if *stats != expected {
+		t.Errorf("expected fd stats %+v, got %+v", expected, *stats)
+	}
+}
+
+func TestCgroupPids(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// the container created a nested cgroup, and the processes of another
+	// one have all exited
+	cgroupDir := path.Join(yqStatDir, "sys/fs/cgroup/pids/docker/test")
+	os.MkdirAll(path.Join(cgroupDir, "nested"), 0755)
+	os.MkdirAll(path.Join(cgroupDir, "exited"), 0755)
+	for file, content := range map[string]string{
+		"cgroup.procs":        "10\n12\n",
+		"nested/cgroup.procs": "11\n14\n",
+		"exited/cgroup.procs": "",
+	} {
+		if err = ioutil.WriteFile(path.Join(cgroupDir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pids, err := cgroupPids(yqStatDir, "/docker/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{10, 12, 11, 14}; !reflect.DeepEqual(pids, expected) {
+		t.Errorf("expected pids %v, got %v", expected, pids)
+	}
+
+	// only the unified hierarchy is mounted
+	unifiedDir := path.Join(yqStatDir, "sys/fs/cgroup/docker/unified")
+	os.MkdirAll(unifiedDir, 0755)
+	if err = ioutil.WriteFile(path.Join(unifiedDir, "cgroup.procs"), []byte("20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pids, err = cgroupPids(yqStatDir, "/docker/unified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{20}; !reflect.DeepEqual(pids, expected) {
+		t.Errorf("expected pids %v, got %v", expected, pids)
+	}
+
+	if _, err = cgroupPids(yqStatDir, "/docker/removed"); err == nil {
+		t.Errorf("expected an error for a removed cgroup")
+	}
+}
+
+func TestGroupPidsByNetns(t *testing.T) {
+	var err error
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	yqStatDir, err := ioutil.TempDir(baseDir, "yq_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(yqStatDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	namespaces := map[int]string{
+		10: "net:[4026532001]",
+		11: "net:[4026532002]",
+		12: "net:[4026532001]",
+		13: "net:[4026532002]",
+	}
+	for pid, link := range namespaces {
+		nsDir := path.Join(yqStatDir, "proc", strconv.Itoa(pid), "ns")
+		os.MkdirAll(nsDir, 0755)
+		if err = os.Symlink(link, path.Join(nsDir, "net")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 14 has exited
+	groups := groupPidsByNetns(yqStatDir, []int{13, 14, 12, 11, 10})
+	expected := map[uint64][]int{
+		4026532001: {10, 12},
+		4026532002: {11, 13},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected pids grouped as %v, got %v", expected, groups)
+	}
+}
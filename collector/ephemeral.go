@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+var ephemeralPortTopN = flag.Int("ephemeral_port_top_n", 5, "Number of destinations using most ephemeral ports to keep per container")
+
+const tcpListen = "0A"
+
+// portRangeFromSysctl reads net.ipv4.ip_local_port_range, which applies to
+// ipv6 as well, from the network namespace of the calling thread.
+func portRangeFromSysctl(rootFs string) (uint64, uint64, error) {
+	var min, max uint64
+
+	portRangeFile := path.Join(rootFs, "proc", "sys", "net/ipv4/ip_local_port_range")
+	data, err := ioutil.ReadFile(portRangeFile)
+	if err != nil {
+		return min, max, err
+	}
+	if _, err = fmt.Sscanf(string(data), "%d %d", &min, &max); err != nil {
+		return min, max, fmt.Errorf("invalid port range %q: %v", data, err)
+	}
+	if max < min {
+		return min, max, fmt.Errorf("invalid port range %q", data)
+	}
+	return min, max, nil
+}
+
+type portTuple struct {
+	localIp    string
+	remoteIp   string
+	remotePort uint16
+}
+
+// ephemeralPortStats counts the local ports within [min, max] used by the
+// outbound sockets of each (local ip, remote ip, remote port) tuple, as the
+// kernel can not pick the same local port twice for a tuple. Sockets on a
+// listening port are inbound connections, whose local port was not picked
+// from the range.
+func ephemeralPortStats(sockets []socket, min, max uint64) types.EphemeralPortStat {
+	stats := types.EphemeralPortStat{
+		RangeMin:  min,
+		RangeMax:  max,
+		Available: max - min + 1,
+	}
+
+	listening := make(map[uint16]struct{})
+	for _, s := range sockets {
+		if s.state == tcpListen {
+			listening[s.localPort] = struct{}{}
+		}
+	}
+
+	used := make(map[portTuple]uint64)
+	for _, s := range sockets {
+		if _, ok := listening[s.localPort]; ok {
+			continue
+		}
+		if uint64(s.localPort) < min || uint64(s.localPort) > max {
+			continue
+		}
+		used[portTuple{s.localIp.String(), s.remoteIp.String(), s.remotePort}]++
+	}
+
+	top := make([]types.EphemeralPortUsage, 0, len(used))
+	for tuple, count := range used {
+		top = append(top, types.EphemeralPortUsage{
+			LocalIp:     tuple.localIp,
+			RemoteIp:    tuple.remoteIp,
+			RemotePort:  tuple.remotePort,
+			Used:        count,
+			Utilization: float64(count) / float64(stats.Available),
+		})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Used != top[j].Used {
+			return top[i].Used > top[j].Used
+		}
+		if top[i].RemoteIp != top[j].RemoteIp {
+			return top[i].RemoteIp < top[j].RemoteIp
+		}
+		return top[i].RemotePort < top[j].RemotePort
+	})
+
+	if len(top) > 0 {
+		stats.MaxUsed = top[0].Used
+		stats.MaxUtilization = top[0].Utilization
+	}
+	if len(top) > *ephemeralPortTopN {
+		top = top[:*ephemeralPortTopN]
+	}
+	stats.Top = top
+	return stats
+}
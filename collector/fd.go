@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+var fdAllProcesses = flag.Bool("fd_all_processes", false, "Count the file descriptors of every process of a container instead of only its init process")
+
+// fdStatsFromProc counts the open file descriptors of pids by type, and
+// finds the process closest to its open files limit, which is per process.
+func fdStatsFromProc(rootFs string, pids []int) *types.FdStat {
+	stats := &types.FdStat{}
+	for _, pid := range pids {
+		procDir := path.Join(rootFs, "proc", strconv.Itoa(pid))
+		fds, err := ioutil.ReadDir(path.Join(procDir, "fd"))
+		if err != nil {
+			// the process has probably exited
+			continue
+		}
+		limit, err := openFilesLimit(path.Join(procDir, "limits"))
+		if err != nil {
+			continue
+		}
+		stats.Processes++
+
+		for _, fd := range fds {
+			link, err := os.Readlink(path.Join(procDir, "fd", fd.Name()))
+			if err != nil {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(link, "socket:"):
+				stats.Sockets++
+			case strings.HasPrefix(link, "pipe:"):
+				stats.Pipes++
+			case strings.HasPrefix(link, "anon_inode:"):
+				stats.AnonInodes++
+			default:
+				stats.Files++
+			}
+		}
+
+		// unlimited processes can not run out of descriptors
+		if limit == 0 {
+			continue
+		}
+		utilization := float64(len(fds)) / float64(limit)
+		if utilization >= stats.MaxUtilization {
+			stats.MaxUtilization = utilization
+			stats.MaxPid = pid
+			stats.MaxOpen = uint64(len(fds))
+			stats.MaxLimit = limit
+		}
+	}
+	return stats
+}
+
+// openFilesLimit reads the soft limit of the "Max open files" line of
+// limitsFile, 0 meaning unlimited.
+func openFilesLimit(limitsFile string) (uint64, error) {
+	f, err := os.Open(limitsFile)
+	if err != nil {
+		return 0, fmt.Errorf("failure opening %s: %v", limitsFile, err)
+	}
+	defer f.Close()
+
+	// Limit                     Soft Limit           Hard Limit           Units
+	// Max open files            1048576              1048576              files
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		fs := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fs) < 1 {
+			return 0, fmt.Errorf("invalid limits line: %v", line)
+		}
+		if fs[0] == "unlimited" {
+			return 0, nil
+		}
+		limit, err := strconv.ParseUint(fs[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid limits line: %v", line)
+		}
+		return limit, nil
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no open files limit in %s", limitsFile)
+}
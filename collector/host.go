@@ -0,0 +1,199 @@
+package collector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	info "github.com/google/cadvisor/info/v1"
+
+	"github.com/yanqing-exporter/collector/types"
+	"github.com/yanqing-exporter/container/docker"
+	"github.com/yanqing-exporter/storage"
+)
+
+// hostStatsFromProc reads the statistics of the root network namespace
+// through the init process of the host.
+func (c *collector) hostStatsFromProc(rootFs string) (*docker.ContainerStats, error) {
+	networkStats, sockets, err := networkStatsFromProc(rootFs, 1)
+	if err != nil {
+		return nil, err
+	}
+	networkStats.Netns, err = netnsInode(rootFs, 1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get netns of host: %v", err)
+	}
+	hostStats := &docker.ContainerStats{
+		Timestamp:    time.Now(),
+		NetworkStats: networkStats,
+	}
+	c.netnsWideStatsFromProc(rootFs, 1, networkStats.Netns, sockets, hostStats)
+	setUdpQueueUtilization(&hostStats.NetworkStats, hostStats.Sysctl.RmemDefault)
+	hostStats.TcpTimers = tcpTimerStats(sockets)
+	hostStats.Churn, hostStats.ConnectionAges = c.conns.update(storage.HostTarget, sockets)
+	return hostStats, nil
+}
+
+// socketInodes returns the inodes of the sockets opened by pids.
+func socketInodes(rootFs string, pids []int) map[uint64]struct{} {
+	inodes := make(map[uint64]struct{})
+	for _, pid := range pids {
+		fdDir := path.Join(rootFs, "proc", strconv.Itoa(pid), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			// the process has probably exited
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(path.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			}
+			var inode uint64
+			if _, err = fmt.Sscanf(link, "socket:[%d]", &inode); err != nil {
+				continue
+			}
+			inodes[inode] = struct{}{}
+		}
+	}
+	return inodes
+}
+
+// socketOwned tells whether the inode column of a proc socket table line is
+// one of inodes.
+func socketOwned(fs []string, inodes map[uint64]struct{}) bool {
+	if len(fs) < 10 {
+		return false
+	}
+	inode, err := strconv.ParseUint(fs[9], 10, 64)
+	if err != nil {
+		return false
+	}
+	_, ok := inodes[inode]
+	return ok
+}
+
+// ownedNetworkStatsFromProc counts only the tcp, udp, raw and ping sockets
+// with one of inodes in the network namespace pid lives in, which is how
+// containers sharing a namespace they did not create are accounted, and
+// returns the owned tcp and tcp6 sockets.
+func ownedNetworkStatsFromProc(rootFs string, pid int, inodes map[uint64]struct{}) (docker.NetworkStats, []socket, error) {
+	var err error
+	var stats docker.NetworkStats
+
+	procDir := path.Join(rootFs, "proc", strconv.Itoa(pid))
+
+	tcpSockets, tcp6Sockets, err := tcpSocketsFromProc(rootFs, pid)
+	if err != nil {
+		return stats, nil, fmt.Errorf("unable to get tcp stats from pid %d: %v", pid, err)
+	}
+	tcpSockets, tcp6Sockets = ownedSockets(tcpSockets, inodes), ownedSockets(tcp6Sockets, inodes)
+	stats.Tcp, stats.TcpWithPort = tcpSocketStats(tcpSockets)
+	stats.Tcp6, stats.Tcp6WithPort = tcpSocketStats(tcp6Sockets)
+
+	stats.Udp, stats.UdpWithPort, err = ownedUdpStats(path.Join(procDir, "net/udp"), inodes)
+	if err != nil {
+		return stats, nil, fmt.Errorf("unable to get udp stats from pid %d: %v", pid, err)
+	}
+
+	stats.Udp6, stats.Udp6WithPort, err = ownedUdpStats(path.Join(procDir, "net/udp6"), inodes)
+	if err != nil {
+		return stats, nil, fmt.Errorf("unable to get udp6 stats from pid %d: %v", pid, err)
+	}
+
+	for _, datagram := range []struct {
+		file  string
+		stats *info.UdpStat
+	}{
+		{"net/raw", &stats.Raw},
+		{"net/raw6", &stats.Raw6},
+		{"net/icmp", &stats.Icmp},
+		{"net/icmp6", &stats.Icmp6},
+	} {
+		datagramStatsFile := path.Join(procDir, datagram.file)
+		if _, err = os.Stat(datagramStatsFile); os.IsNotExist(err) {
+			continue
+		}
+		*datagram.stats, _, err = ownedUdpStats(datagramStatsFile, inodes)
+		if err != nil {
+			return stats, nil, fmt.Errorf("unable to get %s stats from pid %d: %v", path.Base(datagram.file), pid, err)
+		}
+	}
+
+	return stats, append(tcpSockets, tcp6Sockets...), nil
+}
+
+func ownedUdpStats(udpStatsFile string, inodes map[uint64]struct{}) (info.UdpStat, types.UdpStatWithPort, error) {
+	r, err := os.Open(udpStatsFile)
+	if err != nil {
+		return info.UdpStat{}, types.UdpStatWithPort{}, fmt.Errorf("failure opening %s: %v", udpStatsFile, err)
+	}
+	defer r.Close()
+
+	return scanUdpStats(r, inodes)
+}
+
+// unattributedStats returns the tcp, udp, raw and ping sockets of the host
+// which are not owned by any of the given host network containers.
+func unattributedStats(host *docker.ContainerStats, owned []docker.NetworkStats) *docker.ContainerStats {
+	stats := &docker.ContainerStats{
+		Timestamp: host.Timestamp,
+	}
+	stats.Netns = host.Netns
+	stats.Tcp = host.Tcp
+	stats.Udp = host.Udp
+	stats.Tcp6 = host.Tcp6
+	stats.Udp6 = host.Udp6
+	stats.Raw = host.Raw
+	stats.Raw6 = host.Raw6
+	stats.Icmp = host.Icmp
+	stats.Icmp6 = host.Icmp6
+	for _, o := range owned {
+		stats.Tcp = subTcpStat(stats.Tcp, o.Tcp)
+		stats.Udp = subUdpStat(stats.Udp, o.Udp)
+		stats.Tcp6 = subTcpStat(stats.Tcp6, o.Tcp6)
+		stats.Udp6 = subUdpStat(stats.Udp6, o.Udp6)
+		stats.Raw = subUdpStat(stats.Raw, o.Raw)
+		stats.Raw6 = subUdpStat(stats.Raw6, o.Raw6)
+		stats.Icmp = subUdpStat(stats.Icmp, o.Icmp)
+		stats.Icmp6 = subUdpStat(stats.Icmp6, o.Icmp6)
+	}
+	return stats
+}
+
+func subTcpStat(a, b info.TcpStat) info.TcpStat {
+	return info.TcpStat{
+		Established: sub(a.Established, b.Established),
+		SynSent:     sub(a.SynSent, b.SynSent),
+		SynRecv:     sub(a.SynRecv, b.SynRecv),
+		FinWait1:    sub(a.FinWait1, b.FinWait1),
+		FinWait2:    sub(a.FinWait2, b.FinWait2),
+		TimeWait:    sub(a.TimeWait, b.TimeWait),
+		Close:       sub(a.Close, b.Close),
+		CloseWait:   sub(a.CloseWait, b.CloseWait),
+		LastAck:     sub(a.LastAck, b.LastAck),
+		Listen:      sub(a.Listen, b.Listen),
+		Closing:     sub(a.Closing, b.Closing),
+	}
+}
+
+func subUdpStat(a, b info.UdpStat) info.UdpStat {
+	return info.UdpStat{
+		Listen:   sub(a.Listen, b.Listen),
+		Dropped:  sub(a.Dropped, b.Dropped),
+		RxQueued: sub(a.RxQueued, b.RxQueued),
+		TxQueued: sub(a.TxQueued, b.TxQueued),
+	}
+}
+
+// sub subtracts b from a, stopping at zero as both sides are read at
+// slightly different times.
+func sub(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
@@ -0,0 +1,246 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+var ipvsConnections = flag.Bool("ipvs_connections", true, "Count the ipvs connections of each virtual service by state, reading the whole ip_vs_conn table")
+
+type ipvsServiceKey struct {
+	protocol string
+	address  string
+	port     uint16
+}
+
+// ipvsStatsFromProc reads the ipvs virtual services of the host network
+// namespace, where kube-proxy sets them up in ipvs mode, and labels their
+// real servers with the containers of the node owning their ips. It returns
+// nil when ipvs is not loaded.
+func ipvsStatsFromProc(rootFs string, ips map[string]string) (*types.IpvsStat, error) {
+	netDir := path.Join(rootFs, "proc", "1", "net")
+
+	f, err := os.Open(path.Join(netDir, "ip_vs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failure opening %s: %v", path.Join(netDir, "ip_vs"), err)
+	}
+	defer f.Close()
+
+	stats := &types.IpvsStat{}
+	stats.Services, err = scanIpvsServices(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read ipvs services: %v", err)
+	}
+	for i := range stats.Services {
+		for j := range stats.Services[i].Backends {
+			backend := &stats.Services[i].Backends[j]
+			backend.Container = ips[backend.Address]
+		}
+	}
+
+	if err = readIpvsTotals(path.Join(netDir, "ip_vs_stats"), stats); err != nil {
+		return nil, fmt.Errorf("couldn't read ipvs stats: %v", err)
+	}
+
+	if *ipvsConnections {
+		conns, err := os.Open(path.Join(netDir, "ip_vs_conn"))
+		if err != nil {
+			return nil, fmt.Errorf("failure opening %s: %v", path.Join(netDir, "ip_vs_conn"), err)
+		}
+		defer conns.Close()
+		if err = scanIpvsConnections(conns, stats.Services); err != nil {
+			return nil, fmt.Errorf("couldn't read ipvs connections: %v", err)
+		}
+	}
+	return stats, nil
+}
+
+// scanIpvsServices reads a table like
+//
+//	IP Virtual Server version 1.2.1 (size=4096)
+//	Prot LocalAddress:Port Scheduler Flags
+//	  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+//	TCP  0A600001:01BB rr
+//	  -> 0AF40103:192B      Masq    1      0          0
+func scanIpvsServices(r io.Reader) ([]types.IpvsService, error) {
+	scanner := bufio.NewScanner(r)
+	for i := 0; i < 3; i++ {
+		if b := scanner.Scan(); !b {
+			return nil, scanner.Err()
+		}
+	}
+
+	var services []types.IpvsService
+	for scanner.Scan() {
+		line := scanner.Text()
+		fs := strings.Fields(line)
+		if len(fs) == 0 {
+			continue
+		}
+
+		if fs[0] == "->" {
+			if len(fs) < 6 || len(services) == 0 {
+				return nil, fmt.Errorf("invalid ipvs line: %v", line)
+			}
+			var backend types.IpvsBackend
+			var err error
+			backend.Address, backend.Port, err = parseIpvsAddr(fs[1])
+			if err != nil {
+				return nil, err
+			}
+			backend.Forward = strings.ToLower(fs[2])
+			values := []*uint64{&backend.Weight, &backend.ActiveConn, &backend.InactiveConn}
+			for i, value := range values {
+				if *value, err = strconv.ParseUint(fs[3+i], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid ipvs line: %v", line)
+				}
+			}
+			service := &services[len(services)-1]
+			service.Backends = append(service.Backends, backend)
+			continue
+		}
+
+		if len(fs) < 3 {
+			return nil, fmt.Errorf("invalid ipvs line: %v", line)
+		}
+		service := types.IpvsService{
+			Protocol:  strings.ToLower(fs[0]),
+			Scheduler: fs[2],
+		}
+		if fs[0] == "FWM" {
+			// FWM  00000001 rr, services by firewall mark have no address
+			mark, err := strconv.ParseUint(fs[1], 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ipvs line: %v", line)
+			}
+			service.Address = strconv.FormatUint(mark, 10)
+		} else {
+			var err error
+			service.Address, service.Port, err = parseIpvsAddr(fs[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		services = append(services, service)
+	}
+	return services, scanner.Err()
+}
+
+// parseIpvsAddr parses an address like 0A600001:01BB, unlike net/tcp in
+// network byte order, or [fd00::1]:01BB for ipv6.
+func parseIpvsAddr(addr string) (string, uint16, error) {
+	idx := strings.LastIndex(addr, ":")
+	if idx < 0 {
+		return "", 0, fmt.Errorf("invalid ipvs address %q", addr)
+	}
+	port, err := strconv.ParseUint(addr[idx+1:], 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid ipvs address %q", addr)
+	}
+	ip, err := parseIpvsIp(strings.Trim(addr[:idx], "[]"))
+	if err != nil {
+		return "", 0, err
+	}
+	return ip, uint16(port), nil
+}
+
+func parseIpvsIp(s string) (string, error) {
+	if strings.Contains(s, ":") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return "", fmt.Errorf("invalid ipvs address %q", s)
+		}
+		return ip.String(), nil
+	}
+	ip, err := hex.DecodeString(s)
+	if err != nil || len(ip) != net.IPv4len {
+		return "", fmt.Errorf("invalid ipvs address %q", s)
+	}
+	return net.IP(ip).String(), nil
+}
+
+// readIpvsTotals reads the counters of ip_vs_stats, in hex below two header
+// lines.
+func readIpvsTotals(ipvsStatsFile string, stats *types.IpvsStat) error {
+	f, err := os.Open(ipvsStatsFile)
+	if err != nil {
+		return fmt.Errorf("failure opening %s: %v", ipvsStatsFile, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 3; i++ {
+		if b := scanner.Scan(); !b {
+			if err = scanner.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("%s is truncated", ipvsStatsFile)
+		}
+	}
+
+	fs := strings.Fields(scanner.Text())
+	values := []*uint64{&stats.Connections, &stats.IncomingPackets, &stats.OutgoingPackets, &stats.IncomingBytes, &stats.OutgoingBytes}
+	if len(fs) != len(values) {
+		return fmt.Errorf("invalid ipvs stats line: %v", scanner.Text())
+	}
+	for i, value := range values {
+		if *value, err = strconv.ParseUint(fs[i], 16, 64); err != nil {
+			return fmt.Errorf("invalid ipvs stats line: %v", scanner.Text())
+		}
+	}
+	return nil
+}
+
+// scanIpvsConnections counts the connections of ip_vs_conn by virtual
+// service and state, from lines like
+//
+//	Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+//	TCP 0A000101 D8A6 0A600001 01BB 0AF40103 192B ESTABLISHED     899
+func scanIpvsConnections(r io.Reader, services []types.IpvsService) error {
+	index := make(map[ipvsServiceKey]*types.IpvsService, len(services))
+	for i := range services {
+		service := &services[i]
+		service.States = make(map[string]uint64)
+		index[ipvsServiceKey{service.Protocol, service.Address, service.Port}] = service
+	}
+
+	scanner := bufio.NewScanner(r)
+	if b := scanner.Scan(); !b {
+		return scanner.Err()
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		fs := strings.Fields(line)
+		if len(fs) < 8 {
+			return fmt.Errorf("invalid ipvs connection line: %v", line)
+		}
+		address, err := parseIpvsIp(fs[3])
+		if err != nil {
+			return err
+		}
+		port, err := strconv.ParseUint(fs[4], 16, 16)
+		if err != nil {
+			return fmt.Errorf("invalid ipvs connection line: %v", line)
+		}
+		// connections of services by firewall mark are not matched
+		service, ok := index[ipvsServiceKey{strings.ToLower(fs[0]), address, uint16(port)}]
+		if !ok {
+			continue
+		}
+		service.States[strings.ToLower(fs[7])]++
+	}
+	return scanner.Err()
+}
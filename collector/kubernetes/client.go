@@ -0,0 +1,204 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	watchTimeout      = 5 * time.Minute
+)
+
+// client is a minimal client of the kubernetes api, listing and watching
+// core v1 resources.
+type client struct {
+	server     string
+	token      string
+	httpClient *http.Client
+}
+
+// newInClusterClient authenticates with the service account of the pod the
+// exporter runs in.
+func newInClusterClient() (*client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read service account token: %v", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read service account ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account ca")
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     &tls.Config{RootCAs: pool},
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+	return newClient("https://"+net.JoinHostPort(host, port), string(token), httpClient), nil
+}
+
+// newClient returns a client of the api served at server, such as a
+// kubectl proxy when token is empty.
+func newClient(server, token string, httpClient *http.Client) *client {
+	return &client{
+		server:     server,
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// statusError is returned when the api server answers with an error code.
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("kubernetes api returned %d: %s", e.code, e.message)
+}
+
+// isForbidden tells whether err means the service account is not allowed to
+// read a resource.
+func isForbidden(err error) bool {
+	if e, ok := err.(*statusError); ok {
+		return e.code == http.StatusForbidden || e.code == http.StatusUnauthorized
+	}
+	return false
+}
+
+// isGone tells whether err means the resource version to watch from is too
+// old, and the resource has to be listed again.
+func isGone(err error) bool {
+	if e, ok := err.(*statusError); ok {
+		return e.code == http.StatusGone
+	}
+	return false
+}
+
+type objectList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []json.RawMessage `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (c *client) get(ctx context.Context, resource string, query url.Values) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.server+"/api/v1/"+resource+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &statusError{code: resp.StatusCode, message: string(body)}
+	}
+	return resp.Body, nil
+}
+
+// list returns the items of a resource in all namespaces and the version to
+// watch them from.
+func (c *client) list(ctx context.Context, resource string) (objectList, error) {
+	var list objectList
+
+	body, err := c.get(ctx, resource, url.Values{})
+	if err != nil {
+		return list, err
+	}
+	defer body.Close()
+
+	if err = json.NewDecoder(body).Decode(&list); err != nil {
+		return list, fmt.Errorf("invalid %s list: %v", resource, err)
+	}
+	return list, nil
+}
+
+// watch calls handle for each change of a resource since resourceVersion,
+// until the api server ends the watch or ctx is done. The version of the
+// last change is returned.
+func (c *client) watch(ctx context.Context, resource, resourceVersion string, handle func(watchEvent) error) (string, error) {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", fmt.Sprintf("%d", int(watchTimeout.Seconds())))
+	body, err := c.get(ctx, resource, query)
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var event watchEvent
+		if err = decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+
+		switch event.Type {
+		case "ERROR":
+			var s status
+			if err = json.Unmarshal(event.Object, &s); err != nil {
+				return resourceVersion, fmt.Errorf("invalid %s watch error: %v", resource, err)
+			}
+			return resourceVersion, &statusError{code: s.Code, message: s.Message}
+		case "BOOKMARK":
+		default:
+			if err = handle(event); err != nil {
+				return resourceVersion, err
+			}
+		}
+
+		var object struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+		}
+		if err = json.Unmarshal(event.Object, &object); err == nil && object.Metadata.ResourceVersion != "" {
+			resourceVersion = object.Metadata.ResourceVersion
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+const (
+	// LevelWorkload resolves pod ips to the controller of the pod, such as
+	// its deployment, which bounds the number of peers by the number of
+	// workloads of the cluster.
+	LevelWorkload = "workload"
+	// LevelPod resolves pod ips to the pod itself.
+	LevelPod = "pod"
+)
+
+var (
+	apiServer       = flag.String("kubernetes_apiserver", "", "Url of the kubernetes api server such as a kubectl proxy, defaults to the in-cluster service account")
+	peerLevel       = flag.String("kubernetes_peer_level", LevelWorkload, "Resolve pod ips to their workload or to the pod itself, either workload or pod")
+	retryInterval   = 5 * time.Second
+	forbiddenPeriod = 10 * time.Minute
+)
+
+// Resources are watched in order of precedence: the endpoints index only
+// addresses which are not pods, as the ips of services without selectors.
+var resources = []resource{
+	{name: "pods", decode: decodePod},
+	{name: "endpoints", decode: decodeEndpoints},
+	{name: "services", decode: decodeService},
+}
+
+type resource struct {
+	name string
+	// decode returns the key of an object and the ips it owns.
+	decode func(raw json.RawMessage, level string) (string, map[string]types.Workload, error)
+}
+
+// Index resolves the ips of the cluster to the kubernetes workload they
+// belong to, by watching pods, services and endpoints.
+type Index struct {
+	client  *client
+	level   string
+	stores  []*store
+	cancel  context.CancelFunc
+	stopped sync.WaitGroup
+}
+
+// NewIndex returns an index of the cluster the exporter runs in, or of
+// kubernetes_apiserver when set.
+func NewIndex() (*Index, error) {
+	var c *client
+	var err error
+	if *apiServer != "" {
+		c = newClient(strings.TrimSuffix(*apiServer, "/"), "", http.DefaultClient)
+	} else {
+		c, err = newInClusterClient()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newIndex(c, *peerLevel)
+}
+
+func newIndex(c *client, level string) (*Index, error) {
+	if level != LevelWorkload && level != LevelPod {
+		return nil, fmt.Errorf("invalid kubernetes peer level %q", level)
+	}
+
+	index := &Index{
+		client: c,
+		level:  level,
+	}
+	for _, r := range resources {
+		index.stores = append(index.stores, newStore(r))
+	}
+	return index, nil
+}
+
+func (i *Index) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	i.cancel = cancel
+	for _, s := range i.stores {
+		i.stopped.Add(1)
+		go func(s *store) {
+			defer i.stopped.Done()
+			i.run(ctx, s)
+		}(s)
+	}
+	return nil
+}
+
+func (i *Index) Stop() error {
+	i.cancel()
+	i.stopped.Wait()
+	return nil
+}
+
+// Resolve returns the workload an ip belongs to.
+func (i *Index) Resolve(ip string) (types.Workload, bool) {
+	for _, s := range i.stores {
+		if workload, ok := s.resolve(ip); ok {
+			return workload, true
+		}
+	}
+	return types.Workload{}, false
+}
+
+// run keeps the store of a resource in sync until ctx is done. When the
+// service account is not allowed to read the resource, its ips are not
+// resolved and access is checked again every forbiddenPeriod.
+func (i *Index) run(ctx context.Context, s *store) {
+	for {
+		err := i.listAndWatch(ctx, s)
+		if ctx.Err() != nil {
+			return
+		}
+
+		wait := retryInterval
+		if isForbidden(err) {
+			glog.Errorf("Not allowed to read kubernetes %s, their ips will not be resolved: %v", s.resource.name, err)
+			s.replace(nil)
+			wait = forbiddenPeriod
+		} else if err != nil {
+			glog.V(2).Infof("Failed to watch kubernetes %s: %v", s.resource.name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// listAndWatch lists a resource then follows its changes as long as the api
+// server lets the watch resume.
+func (i *Index) listAndWatch(ctx context.Context, s *store) error {
+	list, err := i.client.list(ctx, s.resource.name)
+	if err != nil {
+		return err
+	}
+	objects := make(map[string]map[string]types.Workload, len(list.Items))
+	for _, item := range list.Items {
+		key, ips, err := s.resource.decode(item, i.level)
+		if err != nil {
+			return err
+		}
+		objects[key] = ips
+	}
+	s.replace(objects)
+
+	resourceVersion := list.Metadata.ResourceVersion
+	for {
+		resourceVersion, err = i.client.watch(ctx, s.resource.name, resourceVersion, func(event watchEvent) error {
+			key, ips, err := s.resource.decode(event.Object, i.level)
+			if err != nil {
+				return err
+			}
+			if event.Type == "DELETED" {
+				ips = nil
+			}
+			s.update(key, ips)
+			return nil
+		})
+		if err != nil {
+			if isGone(err) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// store holds the ips owned by the objects of a resource. An ip may be held by
+// several objects for a while, as when the ip of a terminating pod is given to
+// a new one, and then resolves to the object which last set it.
+type store struct {
+	resource resource
+	lock     sync.RWMutex
+	objects  map[string]map[string]types.Workload
+	ips      map[string]owner
+}
+
+type owner struct {
+	key      string
+	workload types.Workload
+}
+
+func newStore(r resource) *store {
+	return &store{
+		resource: r,
+		objects:  make(map[string]map[string]types.Workload),
+		ips:      make(map[string]owner),
+	}
+}
+
+func (s *store) resolve(ip string) (types.Workload, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	o, ok := s.ips[ip]
+	return o.workload, ok
+}
+
+func (s *store) replace(objects map[string]map[string]types.Workload) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects = make(map[string]map[string]types.Workload, len(objects))
+	s.ips = make(map[string]owner)
+	for key, ips := range objects {
+		s.add(key, ips)
+	}
+}
+
+// update sets the ips of an object, removing it when ips is empty. The ips it
+// no longer holds are given back to another object holding them, if any.
+func (s *store) update(key string, ips map[string]types.Workload) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	previous := s.objects[key]
+	delete(s.objects, key)
+	s.add(key, ips)
+
+	for ip := range previous {
+		if _, ok := ips[ip]; ok || s.ips[ip].key != key {
+			continue
+		}
+		delete(s.ips, ip)
+		for other, otherIps := range s.objects {
+			if workload, ok := otherIps[ip]; ok {
+				s.ips[ip] = owner{key: other, workload: workload}
+				break
+			}
+		}
+	}
+}
+
+func (s *store) add(key string, ips map[string]types.Workload) {
+	if len(ips) == 0 {
+		return
+	}
+	s.objects[key] = ips
+	for ip, workload := range ips {
+		s.ips[ip] = owner{key: key, workload: workload}
+	}
+}
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	Labels          map[string]string `json:"labels"`
+	OwnerReferences []ownerReference  `json:"ownerReferences"`
+}
+
+type ownerReference struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Controller bool   `json:"controller"`
+}
+
+func (m objectMeta) key() string {
+	return m.Namespace + "/" + m.Name
+}
+
+type pod struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		HostNetwork bool `json:"hostNetwork"`
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase"`
+		PodIP  string `json:"podIP"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"`
+	} `json:"status"`
+}
+
+// decodePod indexes the ips of running pods. Pods in the host network are
+// left out as they share the ip of their node.
+func decodePod(raw json.RawMessage, level string) (string, map[string]types.Workload, error) {
+	var p pod
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return "", nil, fmt.Errorf("invalid pod: %v", err)
+	}
+	key := p.Metadata.key()
+	if p.Spec.HostNetwork || p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+		return key, nil, nil
+	}
+
+	workload := podWorkload(p.Metadata, level)
+	ips := make(map[string]types.Workload)
+	if p.Status.PodIP != "" {
+		ips[p.Status.PodIP] = workload
+	}
+	for _, ip := range p.Status.PodIPs {
+		if ip.IP != "" {
+			ips[ip.IP] = workload
+		}
+	}
+	return key, ips, nil
+}
+
+// podWorkload returns the controller of a pod, pods of a deployment being
+// owned by one of its replicasets.
+func podWorkload(meta objectMeta, level string) types.Workload {
+	workload := types.Workload{Kind: "pod", Namespace: meta.Namespace, Name: meta.Name}
+	if level == LevelPod {
+		return workload
+	}
+
+	for _, owner := range meta.OwnerReferences {
+		if !owner.Controller {
+			continue
+		}
+		workload.Kind = strings.ToLower(owner.Kind)
+		workload.Name = owner.Name
+		if hash, ok := meta.Labels["pod-template-hash"]; ok && owner.Kind == "ReplicaSet" && strings.HasSuffix(owner.Name, "-"+hash) {
+			workload.Kind = "deployment"
+			workload.Name = strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+		break
+	}
+	return workload
+}
+
+type service struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		ClusterIP  string   `json:"clusterIP"`
+		ClusterIPs []string `json:"clusterIPs"`
+	} `json:"spec"`
+}
+
+// decodeService indexes the cluster ips of services, headless ones having
+// none.
+func decodeService(raw json.RawMessage, level string) (string, map[string]types.Workload, error) {
+	var s service
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", nil, fmt.Errorf("invalid service: %v", err)
+	}
+
+	workload := types.Workload{Kind: "service", Namespace: s.Metadata.Namespace, Name: s.Metadata.Name}
+	ips := make(map[string]types.Workload)
+	for _, ip := range append([]string{s.Spec.ClusterIP}, s.Spec.ClusterIPs...) {
+		if ip != "" && ip != "None" {
+			ips[ip] = workload
+		}
+	}
+	return s.Metadata.key(), ips, nil
+}
+
+type endpointAddress struct {
+	IP        string `json:"ip"`
+	TargetRef *struct {
+		Kind string `json:"kind"`
+	} `json:"targetRef"`
+}
+
+type endpoints struct {
+	Metadata objectMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses         []endpointAddress `json:"addresses"`
+		NotReadyAddresses []endpointAddress `json:"notReadyAddresses"`
+	} `json:"subsets"`
+}
+
+// decodeEndpoints indexes the addresses of a service which are not pods,
+// such as the ips of a database outside the cluster.
+func decodeEndpoints(raw json.RawMessage, level string) (string, map[string]types.Workload, error) {
+	var e endpoints
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return "", nil, fmt.Errorf("invalid endpoints: %v", err)
+	}
+
+	workload := types.Workload{Kind: "service", Namespace: e.Metadata.Namespace, Name: e.Metadata.Name}
+	ips := make(map[string]types.Workload)
+	for _, subset := range e.Subsets {
+		for _, address := range append(subset.Addresses, subset.NotReadyAddresses...) {
+			if address.IP == "" || (address.TargetRef != nil && address.TargetRef.Kind == "Pod") {
+				continue
+			}
+			ips[address.IP] = workload
+		}
+	}
+	return e.Metadata.key(), ips, nil
+}
@@ -0,0 +1,176 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+const PodListContent = `{
+  "kind": "PodList",
+  "metadata": {"resourceVersion": "100"},
+  "items": [
+    {
+      "metadata": {
+        "name": "orders-api-5d8f7c9b4-x2x7q",
+        "namespace": "shop",
+        "labels": {"pod-template-hash": "5d8f7c9b4"},
+        "ownerReferences": [{"kind": "ReplicaSet", "name": "orders-api-5d8f7c9b4", "controller": true}]
+      },
+      "status": {"phase": "Running", "podIP": "10.1.0.5"}
+    },
+    {
+      "metadata": {
+        "name": "postgres-0",
+        "namespace": "db",
+        "ownerReferences": [{"kind": "StatefulSet", "name": "postgres", "controller": true}]
+      },
+      "status": {"phase": "Running", "podIP": "10.1.1.7"}
+    },
+    {
+      "metadata": {"name": "kube-proxy-abcde", "namespace": "kube-system"},
+      "spec": {"hostNetwork": true},
+      "status": {"phase": "Running", "podIP": "192.168.0.10"}
+    }
+  ]
+}`
+
+const PodWatchContent = `{"type": "ADDED", "object": {"metadata": {"name": "batch", "namespace": "jobs", "resourceVersion": "101"}, "status": {"phase": "Running", "podIP": "10.1.2.9"}}}
+{"type": "DELETED", "object": {"metadata": {"name": "postgres-0", "namespace": "db", "resourceVersion": "102"}, "status": {"phase": "Running", "podIP": "10.1.1.7"}}}
+`
+
+const ServiceListContent = `{
+  "kind": "ServiceList",
+  "metadata": {"resourceVersion": "100"},
+  "items": [
+    {"metadata": {"name": "postgres", "namespace": "db"}, "spec": {"clusterIP": "10.96.0.20"}},
+    {"metadata": {"name": "postgres-headless", "namespace": "db"}, "spec": {"clusterIP": "None"}}
+  ]
+}`
+
+func newFakeApiServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		watch := r.URL.Query().Get("watch") == "true"
+		switch r.URL.Path {
+		case "/api/v1/pods":
+			if !watch {
+				fmt.Fprint(w, PodListContent)
+				return
+			}
+			if r.URL.Query().Get("resourceVersion") != "100" {
+				// nothing more happens after the first watch
+				<-r.Context().Done()
+				return
+			}
+			fmt.Fprint(w, PodWatchContent)
+		case "/api/v1/services":
+			if !watch {
+				fmt.Fprint(w, ServiceListContent)
+				return
+			}
+			<-r.Context().Done()
+		case "/api/v1/endpoints":
+			http.Error(w, `endpoints is forbidden: User "system:serviceaccount:default:yanqing-exporter" cannot list resource "endpoints"`, http.StatusForbidden)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// waitResolve polls the index until ip resolves as expected.
+func waitResolve(index *Index, ip string, expected types.Workload, found bool) (types.Workload, bool) {
+	var workload types.Workload
+	var ok bool
+	for i := 0; i < 100; i++ {
+		workload, ok = index.Resolve(ip)
+		if ok == found && workload == expected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return workload, ok
+}
+
+func TestIndexResolve(t *testing.T) {
+	server := newFakeApiServer(t)
+	defer server.Close()
+
+	index, err := newIndex(newClient(server.URL, "", server.Client()), LevelWorkload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Start()
+	defer index.Stop()
+
+	tests := []struct {
+		ip       string
+		workload types.Workload
+		found    bool
+	}{
+		{"10.1.0.5", types.Workload{Kind: "deployment", Namespace: "shop", Name: "orders-api"}, true},
+		{"10.96.0.20", types.Workload{Kind: "service", Namespace: "db", Name: "postgres"}, true},
+		{"10.1.2.9", types.Workload{Kind: "pod", Namespace: "jobs", Name: "batch"}, true},
+		// deleted by the watch
+		{"10.1.1.7", types.Workload{}, false},
+		// pods in the host network are not indexed
+		{"192.168.0.10", types.Workload{}, false},
+	}
+	for _, test := range tests {
+		workload, ok := waitResolve(index, test.ip, test.workload, test.found)
+		if ok != test.found || workload != test.workload {
+			t.Errorf("expected %s to resolve to %+v %v, got %+v %v", test.ip, test.workload, test.found, workload, ok)
+		}
+	}
+}
+
+func TestStoreSharedIp(t *testing.T) {
+	s := newStore(resources[0])
+	old := types.Workload{Kind: "pod", Namespace: "jobs", Name: "batch-1"}
+	recent := types.Workload{Kind: "pod", Namespace: "jobs", Name: "batch-2"}
+
+	// the ip of a terminating pod is given to a new one
+	s.update("jobs/batch-1", map[string]types.Workload{"10.1.2.9": old})
+	s.update("jobs/batch-2", map[string]types.Workload{"10.1.2.9": recent})
+	if workload, ok := s.resolve("10.1.2.9"); !ok || workload != recent {
+		t.Errorf("expected the ip to resolve to the new pod, got %+v %v", workload, ok)
+	}
+	s.update("jobs/batch-1", nil)
+	if workload, ok := s.resolve("10.1.2.9"); !ok || workload != recent {
+		t.Errorf("expected the ip to still resolve to the new pod, got %+v %v", workload, ok)
+	}
+
+	// the new pod is deleted first
+	s.update("jobs/batch-1", map[string]types.Workload{"10.1.2.9": old})
+	s.update("jobs/batch-2", map[string]types.Workload{"10.1.2.9": recent})
+	s.update("jobs/batch-2", nil)
+	if workload, ok := s.resolve("10.1.2.9"); !ok || workload != old {
+		t.Errorf("expected the ip to resolve back to the remaining pod, got %+v %v", workload, ok)
+	}
+	s.update("jobs/batch-1", nil)
+	if workload, ok := s.resolve("10.1.2.9"); ok {
+		t.Errorf("expected the ip to be removed, got %+v", workload)
+	}
+}
+
+func TestPodWorkload(t *testing.T) {
+	meta := objectMeta{
+		Name:      "orders-api-5d8f7c9b4-x2x7q",
+		Namespace: "shop",
+		Labels:    map[string]string{"pod-template-hash": "5d8f7c9b4"},
+		OwnerReferences: []ownerReference{
+			{Kind: "ReplicaSet", Name: "orders-api-5d8f7c9b4", Controller: true},
+		},
+	}
+
+	if workload := podWorkload(meta, LevelWorkload); workload != (types.Workload{Kind: "deployment", Namespace: "shop", Name: "orders-api"}) {
+		t.Errorf("unexpected workload %+v", workload)
+	}
+	if workload := podWorkload(meta, LevelPod); workload != (types.Workload{Kind: "pod", Namespace: "shop", Name: "orders-api-5d8f7c9b4-x2x7q"}) {
+		t.Errorf("unexpected pod %+v", workload)
+	}
+}
@@ -0,0 +1,166 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+// softnetStatsFromProc reads the per cpu backlog statistics of the host,
+// one line of hex counters per cpu starting with processed, dropped and
+// time_squeeze.
+func softnetStatsFromProc(rootFs string) ([]types.SoftnetStat, error) {
+	softnetFile := path.Join(rootFs, "proc", "1", "net/softnet_stat")
+	f, err := os.Open(softnetFile)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening %s: %v", softnetFile, err)
+	}
+	defer f.Close()
+
+	var stats []types.SoftnetStat
+	scanner := bufio.NewScanner(f)
+	for cpu := 0; scanner.Scan(); cpu++ {
+		line := scanner.Text()
+		fs := strings.Fields(line)
+		if len(fs) < 3 {
+			return nil, fmt.Errorf("invalid softnet line: %v", line)
+		}
+		stat := types.SoftnetStat{Cpu: cpu}
+		values := []*uint64{&stat.Processed, &stat.Dropped, &stat.TimeSqueeze}
+		for i, value := range values {
+			if *value, err = strconv.ParseUint(fs[i], 16, 64); err != nil {
+				return nil, fmt.Errorf("invalid softnet line: %v", line)
+			}
+		}
+		// recent kernels skip offline cpus and print the cpu in column 13
+		if len(fs) >= 13 {
+			if index, err := strconv.ParseUint(fs[12], 16, 32); err == nil {
+				stat.Cpu = int(index)
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats, scanner.Err()
+}
+
+// interfaceStatsFromProc reads net/dev of the network namespace pid lives in.
+func interfaceStatsFromProc(rootFs string, pid int) ([]types.InterfaceStat, error) {
+	devFile := path.Join(rootFs, "proc", strconv.Itoa(pid), "net/dev")
+	f, err := os.Open(devFile)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening %s: %v", devFile, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 2; i++ {
+		if b := scanner.Scan(); !b {
+			return nil, scanner.Err()
+		}
+	}
+
+	// eth0: bytes packets errs drop fifo frame compressed multicast|bytes packets errs drop fifo colls carrier compressed
+	var stats []types.InterfaceStat
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.Index(line, ":")
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid net/dev line: %v", line)
+		}
+		fs := strings.Fields(line[idx+1:])
+		if len(fs) < 16 {
+			return nil, fmt.Errorf("invalid net/dev line: %v", line)
+		}
+
+		stat := types.InterfaceStat{Name: strings.TrimSpace(line[:idx])}
+		columns := map[int]*uint64{
+			0:  &stat.RxBytes,
+			1:  &stat.RxPackets,
+			2:  &stat.RxErrors,
+			3:  &stat.RxDropped,
+			8:  &stat.TxBytes,
+			9:  &stat.TxPackets,
+			10: &stat.TxErrors,
+			11: &stat.TxDropped,
+		}
+		for column, value := range columns {
+			if *value, err = strconv.ParseUint(fs[column], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid net/dev line: %v", line)
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats, scanner.Err()
+}
+
+// interfaceLinks returns the ifindex of the peer of each interface of the
+// network namespace pid lives in, read from the sysfs mounted in the
+// container, which for a veth is the ifindex of its host side.
+func interfaceLinks(rootFs string, pid int) map[string]int {
+	interfaces, err := interfaceStatsFromProc(rootFs, pid)
+	if err != nil {
+		return nil
+	}
+
+	links := make(map[string]int)
+	for _, iface := range interfaces {
+		ifindex, err := readIfindex(path.Join(rootFs, "proc", strconv.Itoa(pid), "root/sys/class/net", iface.Name))
+		if err != nil {
+			continue
+		}
+		// interfaces without a peer are their own link
+		if ifindex.iflink != ifindex.ifindex {
+			links[iface.Name] = ifindex.iflink
+		}
+	}
+	return links
+}
+
+type ifindexes struct {
+	ifindex int
+	iflink  int
+}
+
+func readIfindex(ifaceDir string) (ifindexes, error) {
+	var ifi ifindexes
+	for _, f := range []struct {
+		name  string
+		value *int
+	}{
+		{"ifindex", &ifi.ifindex},
+		{"iflink", &ifi.iflink},
+	} {
+		data, err := ioutil.ReadFile(path.Join(ifaceDir, f.name))
+		if err != nil {
+			return ifi, err
+		}
+		if *f.value, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return ifi, fmt.Errorf("invalid %s %q", f.name, data)
+		}
+	}
+	return ifi, nil
+}
+
+// hostInterfaceStats reads the interfaces of the host and labels the host
+// side of veths with the container they link to, containers being found
+// by the ifindex of the host side.
+func hostInterfaceStats(rootFs string, containers map[int]string) ([]types.InterfaceStat, error) {
+	stats, err := interfaceStatsFromProc(rootFs, 1)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stats {
+		ifi, err := readIfindex(path.Join(rootFs, "sys/class/net", stats[i].Name))
+		if err != nil {
+			continue
+		}
+		stats[i].Container = containers[ifi.ifindex]
+	}
+	return stats, nil
+}
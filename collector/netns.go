@@ -0,0 +1,190 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	info "github.com/google/cadvisor/info/v1"
+
+	"github.com/yanqing-exporter/container/docker"
+)
+
+// Hierarchies searched for the process list of a container, the empty one
+// being the cgroup v2 unified hierarchy.
+var cgroupSubsystems = []string{"pids", "cpu,cpuacct", "memory", "systemd", ""}
+
+// cgroupPids returns all processes in the cgroup of a container, including
+// those in nested cgroups created by the container itself.
+func cgroupPids(rootFs string, cgroupName string) ([]int, error) {
+	var err error
+	for _, subsystem := range cgroupSubsystems {
+		cgroupDir := path.Join(rootFs, "sys", "fs", "cgroup", subsystem, cgroupName)
+		if _, err = os.Stat(path.Join(cgroupDir, "cgroup.procs")); err != nil {
+			continue
+		}
+
+		var pids []int
+		err = filepath.Walk(cgroupDir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				// cgroups of exited processes disappear while walking
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if fi.IsDir() || fi.Name() != "cgroup.procs" {
+				return nil
+			}
+			procs, err := readPids(p)
+			if err != nil {
+				return err
+			}
+			pids = append(pids, procs...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return pids, nil
+	}
+	return nil, fmt.Errorf("failure finding cgroup %s: %v", cgroupName, err)
+}
+
+func readPids(procsFile string) ([]int, error) {
+	f, err := os.Open(procsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var pids []int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		pid, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, scanner.Err()
+}
+
+// netnsInode returns the inode of the network namespace of a process.
+func netnsInode(rootFs string, pid int) (uint64, error) {
+	link, err := os.Readlink(path.Join(rootFs, "proc", strconv.Itoa(pid), "ns", "net"))
+	if err != nil {
+		return 0, err
+	}
+
+	// link looks like net:[4026531993]
+	var inode uint64
+	if _, err = fmt.Sscanf(link, "net:[%d]", &inode); err != nil {
+		return 0, fmt.Errorf("invalid netns link %q: %v", link, err)
+	}
+	return inode, nil
+}
+
+// groupPidsByNetns groups pids by the inode of their network namespace.
+// Pids are sorted so the lowest pid of each namespace comes first.
+func groupPidsByNetns(rootFs string, pids []int) map[uint64][]int {
+	sort.Ints(pids)
+
+	namespaces := make(map[uint64][]int)
+	for _, pid := range pids {
+		inode, err := netnsInode(rootFs, pid)
+		if err != nil {
+			// the process has probably exited
+			continue
+		}
+		namespaces[inode] = append(namespaces[inode], pid)
+	}
+	return namespaces
+}
+
+// networkStatsFromProc reads the statistics of the network namespace pid lives
+// in, and returns its tcp and tcp6 sockets, which are only parsed once.
+func networkStatsFromProc(rootFs string, pid int) (docker.NetworkStats, []socket, error) {
+	var err error
+	var stats docker.NetworkStats
+
+	tcpSockets, tcp6Sockets, err := tcpSocketsFromProc(rootFs, pid)
+	if err != nil {
+		return stats, nil, fmt.Errorf("unable to get tcp stats from pid %d: %v", pid, err)
+	}
+	stats.Tcp, stats.TcpWithPort = tcpSocketStats(tcpSockets)
+	stats.Tcp6, stats.Tcp6WithPort = tcpSocketStats(tcp6Sockets)
+
+	stats.Udp, stats.UdpWithPort, err = udpStatsFromProc(rootFs, pid, "net/udp")
+	if err != nil {
+		return stats, nil, fmt.Errorf("unable to get udp stats from pid %d: %v", pid, err)
+	}
+
+	stats.Udp6, stats.Udp6WithPort, err = udpStatsFromProc(rootFs, pid, "net/udp6")
+	if err != nil {
+		return stats, nil, fmt.Errorf("unable to get udp6 stats from pid %d: %v", pid, err)
+	}
+
+	for _, datagram := range []struct {
+		file  string
+		stats *info.UdpStat
+	}{
+		{"net/raw", &stats.Raw},
+		{"net/raw6", &stats.Raw6},
+		{"net/icmp", &stats.Icmp},
+		{"net/icmp6", &stats.Icmp6},
+	} {
+		datagramStats, err := datagramStatsFromProc(rootFs, pid, datagram.file)
+		if err != nil {
+			glog.V(2).Infof("Unable to get %s stats from pid %d: %v", path.Base(datagram.file), pid, err)
+			continue
+		}
+		*datagram.stats = datagramStats
+	}
+
+	stats.TcpExt, err = scanTcpExtStats(rootFs, pid, "net/netstat")
+	if err != nil {
+		return stats, nil, fmt.Errorf("unable to get tcpext stats from pid %d: %v", pid, err)
+	}
+
+	// the optional tables only leave their stats empty when unreadable
+	if sctp, sctpSnmp, err := sctpStatsFromProc(rootFs, pid); err != nil {
+		glog.V(2).Infof("Unable to get sctp stats from pid %d: %v", pid, err)
+	} else {
+		stats.Sctp, stats.SctpSnmp = sctp, sctpSnmp
+	}
+
+	if neighbors, err := neighborStatsFromProc(rootFs, pid); err != nil {
+		glog.V(2).Infof("Unable to get neighbor stats from pid %d: %v", pid, err)
+	} else {
+		stats.Neighbors = neighbors
+	}
+
+	if routes, err := routeStatsFromProc(rootFs, pid); err != nil {
+		glog.V(2).Infof("Unable to get route stats from pid %d: %v", pid, err)
+	} else {
+		stats.Routes = routes
+	}
+
+	return stats, append(tcpSockets, tcp6Sockets...), nil
+}
+
+// datagramStatsFromProc sums raw or ping sockets like udp ones. The tables of
+// protocols the kernel was built without, such as icmp6, are missing.
+func datagramStatsFromProc(rootFs string, pid int, file string) (info.UdpStat, error) {
+	datagramStatsFile := path.Join(rootFs, "proc", strconv.Itoa(pid), file)
+	if _, err := os.Stat(datagramStatsFile); os.IsNotExist(err) {
+		return info.UdpStat{}, nil
+	}
+	stats, _, err := udpStatsFromProc(rootFs, pid, file)
+	return stats, err
+}
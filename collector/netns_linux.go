@@ -0,0 +1,57 @@
+package collector
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// withNetns runs f in the network namespace pid lives in, as what some files
+// such as /proc/sys/net return depends on the namespace of the reading thread
+// rather than on the process they are reached from. f runs on a thread of its
+// own, which is terminated when it can not be moved back to its namespace.
+func withNetns(rootFs string, pid int, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		self, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			done <- fmt.Errorf("failure opening netns of thread: %v", err)
+			return
+		}
+		defer self.Close()
+		target, err := os.Open(path.Join(rootFs, "proc", strconv.Itoa(pid), "ns", "net"))
+		if err != nil {
+			runtime.UnlockOSThread()
+			done <- fmt.Errorf("failure opening netns of pid %d: %v", pid, err)
+			return
+		}
+		defer target.Close()
+
+		if err = setns(target.Fd()); err != nil {
+			runtime.UnlockOSThread()
+			done <- fmt.Errorf("failure entering netns of pid %d: %v", pid, err)
+			return
+		}
+		err = f()
+		if restoreErr := setns(self.Fd()); restoreErr != nil {
+			// the thread is left locked, so that it exits with the goroutine
+			glog.Errorf("Unable to restore netns of thread: %v", restoreErr)
+		} else {
+			runtime.UnlockOSThread()
+		}
+		done <- err
+	}()
+	return <-done
+}
+
+func setns(fd uintptr) error {
+	return unix.Setns(int(fd), unix.CLONE_NEWNET)
+}
@@ -0,0 +1,135 @@
+package collector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/yanqing-exporter/container/docker"
+)
+
+func TestSysctlStats(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("entering a network namespace requires root")
+	}
+	data, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var min, max uint64
+	if _, err = fmt.Sscanf(string(data), "%d %d", &min, &max); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := sysctlStatsFromProc("/", os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.IpLocalPortRangeMin != min || stats.IpLocalPortRangeMax != max {
+		t.Errorf("expected port range %d-%d, got %+v", min, max, stats)
+	}
+	if stats.Somaxconn == 0 || stats.RmemDefault == 0 || stats.RmemMax < stats.RmemDefault {
+		t.Errorf("unexpected sysctls %+v", stats)
+	}
+}
+
+// netnsThread starts a thread in a network namespace of its own, where the
+// sysctls are set, and returns its tid, which is usable as a pid under /proc.
+func netnsThread(t *testing.T, sysctls map[string]string) (int, func()) {
+	type thread struct {
+		tid int
+		err error
+	}
+	ready := make(chan thread)
+	done := make(chan struct{})
+	go func() {
+		// the thread is terminated with the goroutine, as it stays locked
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			ready <- thread{err: err}
+			return
+		}
+		for name, value := range sysctls {
+			if err := ioutil.WriteFile(path.Join("/proc/sys", name), []byte(value), 0644); err != nil {
+				ready <- thread{err: err}
+				return
+			}
+		}
+		ready <- thread{tid: unix.Gettid()}
+		<-done
+	}()
+	th := <-ready
+	if th.err != nil {
+		t.Skipf("unable to create a network namespace: %v", th.err)
+	}
+	return th.tid, func() { close(done) }
+}
+
+func TestReadSysctl(t *testing.T) {
+	// somaxconn differs from the namespace of the test
+	tid, stop := netnsThread(t, map[string]string{"net/core/somaxconn": "1234"})
+	defer stop()
+
+	data, err := ioutil.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pid, expected := range map[int]string{
+		os.Getpid(): strings.TrimSpace(string(data)),
+		tid:         "1234",
+	} {
+		var somaxconn uint64
+		err = withNetns("/", pid, func() error {
+			var err error
+			somaxconn, err = readSysctl("/", "net/core/somaxconn")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strconv.FormatUint(somaxconn, 10) != expected {
+			t.Errorf("expected somaxconn %s in the netns of %d, got %d", expected, pid, somaxconn)
+		}
+	}
+}
+
+func TestUdpQueueUtilization(t *testing.T) {
+	tid, stop := netnsThread(t, nil)
+	defer stop()
+
+	// rmem_default of a namespace is the one of the host, unless it is
+	// only global on older kernels
+	data, err := ioutil.ReadFile("/proc/sys/net/core/rmem_default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmemDefault, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysctl, err := sysctlStatsFromProc("/", tid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sysctl.RmemDefault != rmemDefault {
+		t.Fatalf("expected rmem_default %d, got %+v", rmemDefault, sysctl)
+	}
+
+	_, statsWithPort, err := scanUdpStats(strings.NewReader(UdpStatContent), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networkStats := docker.NetworkStats{UdpWithPort: statsWithPort}
+	setUdpQueueUtilization(&networkStats, sysctl.RmemDefault)
+	expected := float64(0x34000) / float64(rmemDefault)
+	if utilization := networkStats.UdpWithPort.Stats[53].RxQueueUtilization; utilization != expected {
+		t.Errorf("expected rx queue utilization of port 53 to be %v, got %v", expected, utilization)
+	}
+}
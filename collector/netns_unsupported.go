@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package collector
+
+import "fmt"
+
+// withNetns fails as network namespaces are only supported on linux.
+func withNetns(rootFs string, pid int, f func() error) error {
+	return fmt.Errorf("network namespaces are not supported on this platform")
+}
@@ -0,0 +1,182 @@
+package collector
+
+import (
+	"flag"
+	"sort"
+
+	"github.com/yanqing-exporter/collector/types"
+	"github.com/yanqing-exporter/container/docker"
+)
+
+var peersTopN = flag.Int("peers_top_n", 10, "Number of remote ips and ports with most tcp connections to keep per container")
+
+var tcpStateNames = map[string]string{
+	"01": "established",
+	"02": "synsent",
+	"03": "synrecv",
+	"04": "finwait1",
+	"05": "finwait2",
+	"06": "timewait",
+	"07": "close",
+	"08": "closewait",
+	"09": "lastack",
+	"0A": "listen",
+	"0B": "closing",
+}
+
+// peerStats aggregates the tcp connections by remote ip and by remote port,
+// keeping the peers_top_n ones with most connections.
+func peerStats(sockets []socket) types.PeerStat {
+	ips := make(map[string]*types.PeerConnections)
+	ports := make(map[uint16]*types.PeerConnections)
+	for _, s := range sockets {
+		if s.state == tcpListen || s.remoteIp.IsUnspecified() {
+			continue
+		}
+		state := tcpStateNames[s.state]
+
+		ip := s.remoteIp.String()
+		peer, ok := ips[ip]
+		if !ok {
+			peer = &types.PeerConnections{Ip: ip, States: make(map[string]uint64)}
+			ips[ip] = peer
+		}
+		peer.Total++
+		peer.States[state]++
+
+		peer, ok = ports[s.remotePort]
+		if !ok {
+			peer = &types.PeerConnections{Port: s.remotePort, States: make(map[string]uint64)}
+			ports[s.remotePort] = peer
+		}
+		peer.Total++
+		peer.States[state]++
+	}
+
+	stats := types.PeerStat{
+		Ips:   make([]types.PeerConnections, 0, len(ips)),
+		Ports: make([]types.PeerConnections, 0, len(ports)),
+	}
+	for _, peer := range ips {
+		stats.Ips = append(stats.Ips, *peer)
+	}
+	for _, peer := range ports {
+		stats.Ports = append(stats.Ports, *peer)
+	}
+	stats.Ips = topPeers(stats.Ips, *peersTopN)
+	stats.Ports = topPeers(stats.Ports, *peersTopN)
+	return stats
+}
+
+func topPeers(peers []types.PeerConnections, n int) []types.PeerConnections {
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Total != peers[j].Total {
+			return peers[i].Total > peers[j].Total
+		}
+		if peers[i].Ip != peers[j].Ip {
+			return peers[i].Ip < peers[j].Ip
+		}
+		return peers[i].Port < peers[j].Port
+	})
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// containerIps indexes the ips of containers by ip.
+func containerIps(containerInfos map[string]*docker.ContainerInfo) map[string]string {
+	ips := make(map[string]string)
+	for name, container := range containerInfos {
+		for _, ip := range container.Spec.Ips {
+			ips[ip] = name
+		}
+	}
+	return ips
+}
+
+// containerConnections counts the tcp connections of container name with
+// the other containers of the node, found by their ips.
+func containerConnections(name string, sockets []socket, ips map[string]string) []types.ContainerConnections {
+	connections := make(map[string]map[string]uint64)
+	for _, s := range sockets {
+		if s.state == tcpListen {
+			continue
+		}
+		dst, ok := ips[s.remoteIp.String()]
+		if !ok || dst == name {
+			continue
+		}
+		states, ok := connections[dst]
+		if !ok {
+			states = make(map[string]uint64)
+			connections[dst] = states
+		}
+		states[tcpStateNames[s.state]]++
+	}
+
+	result := make([]types.ContainerConnections, 0, len(connections))
+	for dst, states := range connections {
+		result = append(result, types.ContainerConnections{Container: dst, States: states})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Container < result[j].Container
+	})
+	return result
+}
+
+// peerResolver maps a remote ip to the kubernetes workload it belongs to.
+type peerResolver interface {
+	Resolve(ip string) (types.Workload, bool)
+}
+
+// resolvePeers sets the workload of the remote ips known to resolver.
+func resolvePeers(peers []types.PeerConnections, resolver peerResolver) {
+	for i := range peers {
+		if workload, ok := resolver.Resolve(peers[i].Ip); ok {
+			peers[i].Workload = &workload
+		}
+	}
+}
+
+// clusterConnections counts the tcp connections with the kubernetes
+// workloads known to resolver, the containers of the node in ips being
+// counted by containerConnections instead.
+func clusterConnections(sockets []socket, ips map[string]string, resolver peerResolver) []types.ClusterConnections {
+	connections := make(map[types.Workload]map[string]uint64)
+	for _, s := range sockets {
+		if s.state == tcpListen || s.remoteIp.IsUnspecified() {
+			continue
+		}
+		ip := s.remoteIp.String()
+		if _, ok := ips[ip]; ok {
+			continue
+		}
+		workload, ok := resolver.Resolve(ip)
+		if !ok {
+			continue
+		}
+		states, ok := connections[workload]
+		if !ok {
+			states = make(map[string]uint64)
+			connections[workload] = states
+		}
+		states[tcpStateNames[s.state]]++
+	}
+
+	result := make([]types.ClusterConnections, 0, len(connections))
+	for workload, states := range connections {
+		result = append(result, types.ClusterConnections{Workload: workload, States: states})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].Workload, result[j].Workload
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return result
+}
@@ -0,0 +1,157 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+// Flags of arp entries and routes, from linux/if_arp.h and linux/route.h.
+const (
+	arpComplete  = 0x2
+	arpPermanent = 0x4
+
+	routeUp     = 0x1
+	routeReject = 0x200
+)
+
+type neighborKey struct {
+	iface string
+	state string
+}
+
+// neighborStatsFromProc counts the arp entries of the network namespace pid
+// lives in by interface and state. Ipv6 neighbors are only available through
+// netlink.
+func neighborStatsFromProc(rootFs string, pid int) (types.NeighborStat, error) {
+	var stats types.NeighborStat
+
+	arpFile := path.Join(rootFs, "proc", strconv.Itoa(pid), "net/arp")
+	f, err := os.Open(arpFile)
+	if err != nil {
+		return stats, fmt.Errorf("failure opening %s: %v", arpFile, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if b := scanner.Scan(); !b {
+		return stats, scanner.Err()
+	}
+
+	// IP address       HW type     Flags       HW address            Mask     Device
+	counts := make(map[neighborKey]uint64)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fs := strings.Fields(line)
+		if len(fs) < 6 {
+			return stats, fmt.Errorf("invalid arp line: %v", line)
+		}
+		flags, err := strconv.ParseUint(fs[2], 0, 32)
+		if err != nil {
+			return stats, fmt.Errorf("invalid arp line: %v", line)
+		}
+
+		state := "incomplete"
+		switch {
+		case flags&arpPermanent != 0:
+			state = "permanent"
+		case flags&arpComplete != 0:
+			state = "complete"
+		}
+		counts[neighborKey{fs[5], state}]++
+	}
+	if err = scanner.Err(); err != nil {
+		return stats, err
+	}
+
+	for key, count := range counts {
+		stats.Neighbors = append(stats.Neighbors, types.NeighborCount{Interface: key.iface, State: key.state, Count: count})
+	}
+	sort.Slice(stats.Neighbors, func(i, j int) bool {
+		if stats.Neighbors[i].Interface != stats.Neighbors[j].Interface {
+			return stats.Neighbors[i].Interface < stats.Neighbors[j].Interface
+		}
+		return stats.Neighbors[i].State < stats.Neighbors[j].State
+	})
+	return stats, nil
+}
+
+// routeStatsFromProc counts the routes of the network namespace pid lives in
+// and tells whether they include a default route. The ipv6 table is missing
+// when ipv6 is disabled.
+func routeStatsFromProc(rootFs string, pid int) (types.RouteStat, error) {
+	var stats types.RouteStat
+	var err error
+
+	procDir := path.Join(rootFs, "proc", strconv.Itoa(pid))
+
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+	stats.Routes, stats.DefaultRoute, err = scanRoutes(path.Join(procDir, "net/route"), true, func(fs []string) (bool, string, error) {
+		if len(fs) < 8 {
+			return false, "", fmt.Errorf("invalid route line: %v", strings.Join(fs, " "))
+		}
+		return fs[1] == "00000000" && fs[7] == "00000000", fs[3], nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	ipv6RouteFile := path.Join(procDir, "net/ipv6_route")
+	if _, err = os.Stat(ipv6RouteFile); os.IsNotExist(err) {
+		return stats, nil
+	}
+	stats.Ipv6 = true
+	// dest dest_prefixlen src src_prefixlen next_hop metric refcnt use flags iface
+	stats.Routes6, stats.DefaultRoute6, err = scanRoutes(ipv6RouteFile, false, func(fs []string) (bool, string, error) {
+		if len(fs) < 10 {
+			return false, "", fmt.Errorf("invalid ipv6 route line: %v", strings.Join(fs, " "))
+		}
+		return fs[0] == strings.Repeat("0", 32) && fs[1] == "00", fs[8], nil
+	})
+	return stats, err
+}
+
+// scanRoutes counts the usable routes of routeFile, parse telling whether a
+// route is a default one and returning its hex flags.
+func scanRoutes(routeFile string, header bool, parse func(fs []string) (bool, string, error)) (uint64, bool, error) {
+	f, err := os.Open(routeFile)
+	if err != nil {
+		return 0, false, fmt.Errorf("failure opening %s: %v", routeFile, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if header {
+		if b := scanner.Scan(); !b {
+			return 0, false, scanner.Err()
+		}
+	}
+
+	var routes uint64
+	var defaultRoute bool
+	for scanner.Scan() {
+		isDefault, hexFlags, err := parse(strings.Fields(scanner.Text()))
+		if err != nil {
+			return 0, false, err
+		}
+		flags, err := strconv.ParseUint(hexFlags, 16, 32)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid route flags %q", hexFlags)
+		}
+		// unreachable routes such as the ipv6 one of the loopback do not count
+		if flags&routeUp == 0 || flags&routeReject != 0 {
+			continue
+		}
+		routes++
+		if isDefault {
+			defaultRoute = true
+		}
+	}
+	return routes, defaultRoute, scanner.Err()
+}
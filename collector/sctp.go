@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+// sctpStatsFromProc reads net/sctp/assocs, eps and snmp of pid. Namespaces
+// without the sctp module loaded have no net/sctp and report zero stats.
+func sctpStatsFromProc(rootFs string, pid int) (types.SctpStat, types.SctpSnmpStat, error) {
+	var stats types.SctpStat
+	var snmpStats types.SctpSnmpStat
+
+	sctpDir := path.Join(rootFs, "proc", strconv.Itoa(pid), "net", "sctp")
+	if _, err := os.Stat(sctpDir); os.IsNotExist(err) {
+		return stats, snmpStats, nil
+	}
+
+	r, err := os.Open(path.Join(sctpDir, "assocs"))
+	if err != nil {
+		return stats, snmpStats, fmt.Errorf("failure opening sctp assocs: %v", err)
+	}
+	defer r.Close()
+	stats, err = scanSctpAssocs(r)
+	if err != nil {
+		return stats, snmpStats, fmt.Errorf("couldn't read sctp assocs: %v", err)
+	}
+
+	e, err := os.Open(path.Join(sctpDir, "eps"))
+	if err != nil {
+		return stats, snmpStats, fmt.Errorf("failure opening sctp eps: %v", err)
+	}
+	defer e.Close()
+	stats.Endpoints, err = countProcLines(e)
+	if err != nil {
+		return stats, snmpStats, fmt.Errorf("couldn't read sctp eps: %v", err)
+	}
+
+	s, err := os.Open(path.Join(sctpDir, "snmp"))
+	if err != nil {
+		return stats, snmpStats, fmt.Errorf("failure opening sctp snmp: %v", err)
+	}
+	defer s.Close()
+	snmpStats, err = scanSctpSnmp(s)
+	if err != nil {
+		return stats, snmpStats, fmt.Errorf("couldn't read sctp snmp: %v", err)
+	}
+
+	return stats, snmpStats, nil
+}
+
+func scanSctpAssocs(r io.Reader) (types.SctpStat, error) {
+	var stats types.SctpStat
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	if b := scanner.Scan(); !b {
+		return stats, scanner.Err()
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// ASSOC SOCK STY SST ST ...
+		fs := strings.Fields(line)
+		if len(fs) < 5 {
+			return stats, fmt.Errorf("invalid SCTP assocs line: %v", line)
+		}
+		switch fs[4] {
+		case "0":
+			stats.Closed++
+		case "1":
+			stats.CookieWait++
+		case "2":
+			stats.CookieEchoed++
+		case "3":
+			stats.Established++
+		case "4":
+			stats.ShutdownPending++
+		case "5":
+			stats.ShutdownSent++
+		case "6":
+			stats.ShutdownReceived++
+		case "7":
+			stats.ShutdownAckSent++
+		default:
+			return stats, fmt.Errorf("invalid SCTP assocs line: %v", line)
+		}
+	}
+
+	return stats, scanner.Err()
+}
+
+// countProcLines counts the entries of a proc table, skipping its header.
+func countProcLines(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	if b := scanner.Scan(); !b {
+		return 0, scanner.Err()
+	}
+
+	count := uint64(0)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) > 0 {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+func scanSctpSnmp(r io.Reader) (types.SctpSnmpStat, error) {
+	var stats types.SctpSnmpStat
+
+	ret := map[string]uint64{}
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		fs := strings.Fields(scanner.Text())
+		if len(fs) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fs[1], 10, 64)
+		if err != nil {
+			return stats, err
+		}
+		ret[fs[0]] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+
+	stats = types.SctpSnmpStat{
+		SctpCurrEstab:           ret["SctpCurrEstab"],
+		SctpActiveEstabs:        ret["SctpActiveEstabs"],
+		SctpPassiveEstabs:       ret["SctpPassiveEstabs"],
+		SctpAborteds:            ret["SctpAborteds"],
+		SctpShutdowns:           ret["SctpShutdowns"],
+		SctpOutOfBlues:          ret["SctpOutOfBlues"],
+		SctpChecksumErrors:      ret["SctpChecksumErrors"],
+		SctpT1InitExpireds:      ret["SctpT1InitExpireds"],
+		SctpT1CookieExpireds:    ret["SctpT1CookieExpireds"],
+		SctpT2ShutdownExpireds:  ret["SctpT2ShutdownExpireds"],
+		SctpT3RtxExpireds:       ret["SctpT3RtxExpireds"],
+		SctpT4RtoExpireds:       ret["SctpT4RtoExpireds"],
+		SctpT3Retransmits:       ret["SctpT3Retransmits"],
+		SctpFastRetransmits:     ret["SctpFastRetransmits"],
+		SctpInPktDiscards:       ret["SctpInPktDiscards"],
+		SctpInDataChunkDiscards: ret["SctpInDataChunkDiscards"],
+	}
+	return stats, nil
+}
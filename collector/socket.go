@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+// Timers pending on a tcp socket, from the tr column of net/tcp.
+const (
+	timerRetransmit      = "01"
+	timerKeepalive       = "02"
+	timerZeroWindowProbe = "04"
+)
+
+// socket is an entry of a proc socket table such as net/tcp.
+type socket struct {
+	localIp    net.IP
+	localPort  uint16
+	remoteIp   net.IP
+	remotePort uint16
+	state      string
+	// timer is the kind of timer pending on the socket, and retransmits the
+	// number of unrecovered retransmission timeouts.
+	timer       string
+	retransmits uint64
+	inode       uint64
+}
+
+// tcpSocketsFromProc reads the tcp and tcp6 sockets of the network namespace
+// pid lives in.
+func tcpSocketsFromProc(rootFs string, pid int) ([]socket, []socket, error) {
+	tcpSockets, err := readSockets(path.Join(rootFs, "proc", strconv.Itoa(pid), "net/tcp"))
+	if err != nil {
+		return nil, nil, err
+	}
+	tcp6Sockets, err := readSockets(path.Join(rootFs, "proc", strconv.Itoa(pid), "net/tcp6"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return tcpSockets, tcp6Sockets, nil
+}
+
+func readSockets(socketsFile string) ([]socket, error) {
+	f, err := os.Open(socketsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening %s: %v", socketsFile, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanLines)
+
+	if b := scanner.Scan(); !b {
+		return nil, scanner.Err()
+	}
+
+	var sockets []socket
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fs := strings.Fields(line)
+		if len(fs) < 10 {
+			return nil, fmt.Errorf("invalid socket line: %v", line)
+		}
+
+		var s socket
+		s.localIp, s.localPort, err = parseSocketAddr(fs[1])
+		if err != nil {
+			return nil, err
+		}
+		s.remoteIp, s.remotePort, err = parseSocketAddr(fs[2])
+		if err != nil {
+			return nil, err
+		}
+		s.state = fs[3]
+		if _, ok := tcpStateNames[s.state]; !ok {
+			return nil, fmt.Errorf("invalid socket line: %v", line)
+		}
+		// tr:tm->when
+		if idx := strings.Index(fs[5], ":"); idx > 0 {
+			s.timer = fs[5][:idx]
+		}
+		s.retransmits, err = strconv.ParseUint(fs[6], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket line: %v", line)
+		}
+		s.inode, err = strconv.ParseUint(fs[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket line: %v", line)
+		}
+		sockets = append(sockets, s)
+	}
+
+	return sockets, scanner.Err()
+}
+
+// parseSocketAddr parses an address like 0100007F:1F90, made of the ip in
+// host byte order by 32 bits words and the port, both in hex.
+func parseSocketAddr(addr string) (net.IP, uint16, error) {
+	idx := strings.Index(addr, ":")
+	if idx < 0 {
+		return nil, 0, fmt.Errorf("invalid socket address %q", addr)
+	}
+
+	ip, err := hex.DecodeString(addr[:idx])
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid socket address %q", addr)
+	}
+	// assuming a little endian host
+	for i := 0; i < len(ip); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = ip[i+3], ip[i+2], ip[i+1], ip[i]
+	}
+
+	port, err := strconv.ParseUint(addr[idx+1:], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid socket address %q", addr)
+	}
+	return net.IP(ip), uint16(port), nil
+}
+
+// ownedSockets keeps only the sockets with one of inodes.
+func ownedSockets(sockets []socket, inodes map[uint64]struct{}) []socket {
+	owned := make([]socket, 0, len(sockets))
+	for _, s := range sockets {
+		if _, ok := inodes[s.inode]; ok {
+			owned = append(owned, s)
+		}
+	}
+	return owned
+}
+
+// tcpTimerStats counts the sockets waiting on a retransmission or a zero
+// window probe, which happen when the peer is unreachable or stops reading.
+func tcpTimerStats(sockets []socket) types.TcpTimerStat {
+	var stats types.TcpTimerStat
+	for _, s := range sockets {
+		switch s.timer {
+		case timerRetransmit:
+			stats.Retransmit++
+		case timerKeepalive:
+			stats.Keepalive++
+		case timerZeroWindowProbe:
+			stats.ZeroWindowProbe++
+		}
+		if s.retransmits > stats.MaxRetransmits {
+			stats.MaxRetransmits = s.retransmits
+			stats.MaxRetransmitsPeer = s.remoteIp.String()
+		}
+	}
+	return stats
+}
@@ -0,0 +1,154 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yanqing-exporter/collector/types"
+)
+
+var sysctlInterval = flag.Duration("sysctl_interval", 5*time.Minute, "Interval between reads of the network sysctls of a network namespace")
+
+type sysctlSnapshot struct {
+	timestamp time.Time
+	stats     types.SysctlStat
+}
+
+// sysctlCache keeps the network sysctls last read from each network
+// namespace, as they rarely change.
+type sysctlCache struct {
+	lock      sync.Mutex
+	snapshots map[uint64]sysctlSnapshot
+}
+
+func newSysctlCache() *sysctlCache {
+	return &sysctlCache{
+		snapshots: make(map[uint64]sysctlSnapshot),
+	}
+}
+
+// get returns the sysctls of the network namespace netns which pid lives
+// in, reading them again once sysctl_interval has elapsed.
+func (sc *sysctlCache) get(rootFs string, pid int, netns uint64) (types.SysctlStat, error) {
+	now := time.Now()
+	sc.lock.Lock()
+	snapshot, ok := sc.snapshots[netns]
+	sc.lock.Unlock()
+	if ok && now.Sub(snapshot.timestamp) < *sysctlInterval {
+		return snapshot.stats, nil
+	}
+
+	stats, err := sysctlStatsFromProc(rootFs, pid)
+	if err != nil {
+		return stats, err
+	}
+	// the namespace is unknown when its inode could not be read
+	if netns != 0 {
+		sc.lock.Lock()
+		sc.snapshots[netns] = sysctlSnapshot{timestamp: now, stats: stats}
+		sc.lock.Unlock()
+	}
+	return stats, nil
+}
+
+// expire forgets the namespaces which have not been read for a while.
+func (sc *sysctlCache) expire() {
+	now := time.Now()
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	for netns, snapshot := range sc.snapshots {
+		if now.Sub(snapshot.timestamp) > 2*(*sysctlInterval) {
+			delete(sc.snapshots, netns)
+		}
+	}
+}
+
+// sysctlStatsFromProc reads the sysctls of the network namespace pid lives in
+// from within it.
+func sysctlStatsFromProc(rootFs string, pid int) (types.SysctlStat, error) {
+	var stats types.SysctlStat
+
+	sysctls := []struct {
+		name  string
+		value *uint64
+	}{
+		{"net/core/somaxconn", &stats.Somaxconn},
+		{"net/ipv4/tcp_max_syn_backlog", &stats.TcpMaxSynBacklog},
+		{"net/ipv4/tcp_tw_reuse", &stats.TcpTwReuse},
+		{"net/ipv4/tcp_fin_timeout", &stats.TcpFinTimeout},
+		{"net/ipv4/tcp_keepalive_time", &stats.TcpKeepaliveTime},
+	}
+	// socket buffer sysctls are only per namespace on recent kernels, and
+	// are read from the host otherwise
+	globalSysctls := []struct {
+		name  string
+		value *uint64
+	}{
+		{"net/core/rmem_default", &stats.RmemDefault},
+		{"net/core/rmem_max", &stats.RmemMax},
+	}
+	global := false
+	err := withNetns(rootFs, pid, func() error {
+		var err error
+		for _, sysctl := range sysctls {
+			*sysctl.value, err = readSysctl(rootFs, sysctl.name)
+			if err != nil {
+				return err
+			}
+		}
+
+		stats.IpLocalPortRangeMin, stats.IpLocalPortRangeMax, err = portRangeFromSysctl(rootFs)
+		if err != nil {
+			return err
+		}
+
+		for _, sysctl := range globalSysctls {
+			*sysctl.value, err = readSysctl(rootFs, sysctl.name)
+			if os.IsNotExist(err) {
+				global = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || !global {
+		return stats, err
+	}
+
+	err = withNetns(rootFs, 1, func() error {
+		var err error
+		for _, sysctl := range globalSysctls {
+			*sysctl.value, err = readSysctl(rootFs, sysctl.name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// readSysctl reads a sysctl of the network namespace of the calling thread,
+// which has to be locked in it.
+func readSysctl(rootFs string, name string) (uint64, error) {
+	sysctlFile := path.Join(rootFs, "proc", "sys", name)
+	data, err := ioutil.ReadFile(sysctlFile)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sysctl %s: %v", name, err)
+	}
+	return value, nil
+}
@@ -32,3 +32,263 @@ type TcpExtStat struct {
 type TcpStatWithPort struct {
 	Stats map[int64]info.TcpStat
 }
+
+type UdpStatWithPort struct {
+	Stats map[int64]UdpPortStat
+}
+
+// UdpPortStat sums the udp sockets bound to a port. RxQueueUtilization is
+// the highest rx queue of a socket as a fraction of net.core.rmem_default,
+// the receive buffer of sockets not setting SO_RCVBUF.
+type UdpPortStat struct {
+	Sockets            uint64
+	Dropped            uint64
+	RxQueued           uint64
+	TxQueued           uint64
+	MaxRxQueued        uint64
+	RxQueueUtilization float64
+}
+
+// SctpStat counts the SCTP associations of a network namespace by state,
+// and its SCTP endpoints.
+type SctpStat struct {
+	Closed           uint64
+	CookieWait       uint64
+	CookieEchoed     uint64
+	Established      uint64
+	ShutdownPending  uint64
+	ShutdownSent     uint64
+	ShutdownReceived uint64
+	ShutdownAckSent  uint64
+	Endpoints        uint64
+}
+
+type SctpSnmpStat struct {
+	SctpCurrEstab           uint64
+	SctpActiveEstabs        uint64
+	SctpPassiveEstabs       uint64
+	SctpAborteds            uint64
+	SctpShutdowns           uint64
+	SctpOutOfBlues          uint64
+	SctpChecksumErrors      uint64
+	SctpT1InitExpireds      uint64
+	SctpT1CookieExpireds    uint64
+	SctpT2ShutdownExpireds  uint64
+	SctpT3RtxExpireds       uint64
+	SctpT4RtoExpireds       uint64
+	SctpT3Retransmits       uint64
+	SctpFastRetransmits     uint64
+	SctpInPktDiscards       uint64
+	SctpInDataChunkDiscards uint64
+}
+
+// EphemeralPortStat is the usage of the ephemeral port range, for the
+// (local ip, remote ip, remote port) tuple using most of it.
+type EphemeralPortStat struct {
+	RangeMin       uint64
+	RangeMax       uint64
+	Available      uint64
+	MaxUsed        uint64
+	MaxUtilization float64
+	// Top are the tuples using most ephemeral ports.
+	Top []EphemeralPortUsage
+}
+
+type EphemeralPortUsage struct {
+	LocalIp     string
+	RemoteIp    string
+	RemotePort  uint16
+	Used        uint64
+	Utilization float64
+}
+
+// SysctlStat holds the network sysctls of a network namespace.
+type SysctlStat struct {
+	Somaxconn           uint64
+	TcpMaxSynBacklog    uint64
+	TcpTwReuse          uint64
+	TcpFinTimeout       uint64
+	TcpKeepaliveTime    uint64
+	IpLocalPortRangeMin uint64
+	IpLocalPortRangeMax uint64
+	RmemDefault         uint64
+	RmemMax             uint64
+}
+
+// PeerStat holds the remote ips and remote ports with most tcp connections.
+type PeerStat struct {
+	Ips   []PeerConnections
+	Ports []PeerConnections
+}
+
+// PeerConnections counts the tcp connections with a remote ip or port by
+// state, Total being their sum.
+type PeerConnections struct {
+	Ip     string `json:",omitempty"`
+	Port   uint16 `json:",omitempty"`
+	Total  uint64
+	States map[string]uint64
+	// Workload owns Ip in the kubernetes cluster, when it is known.
+	Workload *Workload `json:",omitempty"`
+}
+
+// ContainerConnections counts by state the tcp connections with another
+// container of the node.
+type ContainerConnections struct {
+	Container string
+	States    map[string]uint64
+}
+
+// Workload identifies the kubernetes object an ip belongs to, which is a pod
+// or its controller such as a deployment, or a service.
+type Workload struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// ClusterConnections counts by state the tcp connections with a kubernetes
+// workload which is not running on the node.
+type ClusterConnections struct {
+	Workload
+	States map[string]uint64
+}
+
+// ChurnStat counts the tcp connections opened and closed, inbound ones being
+// accepted on a listening port.
+type ChurnStat struct {
+	InboundOpened  uint64
+	InboundClosed  uint64
+	OutboundOpened uint64
+	OutboundClosed uint64
+}
+
+// ConnectionChurnStat counts the tcp connections opened and closed since the
+// previous collection, and since the container is tracked.
+type ConnectionChurnStat struct {
+	Interval ChurnStat
+	Total    ChurnStat
+}
+
+// ConnectionAgeStat is the histogram of the age in seconds of the tcp
+// connections in a state, Buckets counting the connections not older than
+// each upper bound.
+type ConnectionAgeStat struct {
+	State   string
+	Count   uint64
+	Sum     float64
+	Max     float64
+	Buckets []AgeBucket
+}
+
+// AgeBucket is a cumulative histogram bucket. Buckets are a slice rather than
+// a map by upper bound as json has no float keys.
+type AgeBucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// TcpTimerStat counts the tcp sockets by pending timer. MaxRetransmits is the
+// highest number of unrecovered retransmission timeouts of a socket, and
+// MaxRetransmitsPeer its remote ip.
+type TcpTimerStat struct {
+	Retransmit         uint64
+	ZeroWindowProbe    uint64
+	Keepalive          uint64
+	MaxRetransmits     uint64
+	MaxRetransmitsPeer string `json:",omitempty"`
+}
+
+// IpvsStat holds the ipvs virtual services of the host and the counters of
+// all of them.
+type IpvsStat struct {
+	Connections     uint64
+	IncomingPackets uint64
+	OutgoingPackets uint64
+	IncomingBytes   uint64
+	OutgoingBytes   uint64
+	Services        []IpvsService
+}
+
+// IpvsService is a virtual service, Address being the firewall mark of fwm
+// services. States counts its connections by state.
+type IpvsService struct {
+	Protocol  string
+	Address   string
+	Port      uint16
+	Scheduler string
+	Backends  []IpvsBackend
+	States    map[string]uint64 `json:",omitempty"`
+}
+
+// IpvsBackend is a real server of a virtual service, Container being the
+// container of the node with its ip.
+type IpvsBackend struct {
+	Address      string
+	Port         uint16
+	Forward      string
+	Weight       uint64
+	ActiveConn   uint64
+	InactiveConn uint64
+	Container    string `json:",omitempty"`
+}
+
+// NeighborStat counts the arp entries by interface and state.
+type NeighborStat struct {
+	Neighbors []NeighborCount
+}
+
+type NeighborCount struct {
+	Interface string
+	State     string
+	Count     uint64
+}
+
+// RouteStat counts the usable routes, Ipv6 telling whether ipv6 is enabled.
+type RouteStat struct {
+	Routes        uint64
+	DefaultRoute  bool
+	Ipv6          bool
+	Routes6       uint64
+	DefaultRoute6 bool
+}
+
+// SoftnetStat holds the backlog counters of a cpu, TimeSqueeze counting the
+// times packet processing ran out of budget with work remaining.
+type SoftnetStat struct {
+	Cpu         int
+	Processed   uint64
+	Dropped     uint64
+	TimeSqueeze uint64
+}
+
+// InterfaceStat holds the counters of a network interface. Container is the
+// container a veth links to, for the host side of veths.
+type InterfaceStat struct {
+	Name      string
+	Container string `json:",omitempty"`
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDropped uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDropped uint64
+}
+
+// FdStat counts the open file descriptors of the processes of a container by
+// type. The open files limit applies to each process, so MaxOpen and MaxLimit
+// belong to the process MaxPid closest to its soft limit, MaxUtilization
+// being their ratio.
+type FdStat struct {
+	Processes      uint64
+	Sockets        uint64
+	Pipes          uint64
+	AnonInodes     uint64
+	Files          uint64
+	MaxPid         int
+	MaxOpen        uint64
+	MaxLimit       uint64
+	MaxUtilization float64
+}
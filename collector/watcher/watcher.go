@@ -2,6 +2,7 @@ package watcher
 
 import (
 	"flag"
+	"sort"
 	"time"
 
 	dclient "github.com/docker/engine-api/client"
@@ -79,6 +80,15 @@ func (w *watcher) getContainerInfo() error {
 		return err
 	}
 
+	// --net=container:<id> refers to a container by id or name
+	containerNames := make(map[string]string, 2*len(allDockerContainerInfo))
+	for _, container := range allDockerContainerInfo {
+		containerNames[container.Id] = container.Name
+		for _, alias := range container.Aliases {
+			containerNames[alias] = container.Name
+		}
+	}
+
 	for _, container := range allDockerContainerInfo {
 		ctnr, err = w.getContainerInspect(container.Id)
 		if nil != err {
@@ -98,11 +108,45 @@ func (w *watcher) getContainerInfo() error {
 				CreationTime: creationTime,
 			},
 		}
+		if ctnr.NetworkSettings != nil {
+			cinfo.Spec.Ips = containerIps(ctnr.NetworkSettings)
+		}
+		if ctnr.HostConfig != nil {
+			networkMode := ctnr.HostConfig.NetworkMode
+			cinfo.Spec.NetworkMode = string(networkMode)
+			if networkMode.IsContainer() {
+				cinfo.Spec.NetworkContainer = containerNames[networkMode.ConnectedContainer()]
+			}
+		}
 		w.cacheStorage.UpdateContainerInfo(container.Name, cinfo)
 	}
 	return nil
 }
 
+// containerIps returns the addresses of a container on all its networks.
+func containerIps(settings *dtypes.NetworkSettings) []string {
+	seen := make(map[string]bool)
+	var ips []string
+	add := func(ip string) {
+		if ip != "" && !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+
+	add(settings.IPAddress)
+	add(settings.GlobalIPv6Address)
+	for _, endpoint := range settings.Networks {
+		if endpoint == nil {
+			continue
+		}
+		add(endpoint.IPAddress)
+		add(endpoint.GlobalIPv6Address)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
 func (w *watcher) getContainerInspect(id string) (dtypes.ContainerJSON, error) {
 	ctnr, err := w.dockerClient.ContainerInspect(id)
 	if err != nil {
@@ -8,6 +8,12 @@ import (
 	"github.com/yanqing-exporter/collector/types"
 )
 
+// Kinds of network a container can be attached to besides its own namespace.
+const (
+	NetworkModeHost      = "host"
+	NetworkModeContainer = "container"
+)
+
 type ContainerInfo struct {
 	info.ContainerReference
 	Spec  ContainerSpec     `json:"spec,omitempty"`
@@ -18,15 +24,82 @@ type ContainerSpec struct {
 	Image        string    `json:"image,omitempty"`
 	Pid          int       `json:"pid,omitempty"`
 	CreationTime time.Time `json:"creation_time,omitempty"`
+	// NetworkMode is the HostConfig.NetworkMode of the container.
+	NetworkMode string `json:"network_mode,omitempty"`
+	// NetworkContainer is the name of the container whose network namespace
+	// is joined with --net=container:<id>.
+	NetworkContainer string `json:"network_container,omitempty"`
+	// Ips are the addresses of the container on its docker networks.
+	Ips []string `json:"ips,omitempty"`
 }
 
-type ContainerStats struct {
-	Timestamp    time.Time             `json:"timestamp"`
-	Tcp          info.TcpStat          `json:"tcp"`
-	Udp          info.UdpStat          `json:"udp"`
-	Tcp6         info.TcpStat          `json:"tcp6"`
-	Udp6         info.UdpStat          `json:"udp6"`
-	TcpExt       types.TcpExtStat      `json:"tcpext"`
+// NetworkStats holds the statistics read from a single network namespace.
+type NetworkStats struct {
+	Netns uint64       `json:"netns,omitempty"`
+	Pids  []int        `json:"pids,omitempty"`
+	Tcp   info.TcpStat `json:"tcp"`
+	Udp   info.UdpStat `json:"udp"`
+	Tcp6  info.TcpStat `json:"tcp6"`
+	Udp6  info.UdpStat `json:"udp6"`
+	// Raw and ping sockets, counted as udp sockets.
+	Raw       info.UdpStat       `json:"raw"`
+	Raw6      info.UdpStat       `json:"raw6"`
+	Icmp      info.UdpStat       `json:"icmp"`
+	Icmp6     info.UdpStat       `json:"icmp6"`
+	TcpExt    types.TcpExtStat   `json:"tcpext"`
+	Sctp      types.SctpStat     `json:"sctp"`
+	SctpSnmp  types.SctpSnmpStat `json:"sctpsnmp"`
+	Neighbors types.NeighborStat `json:"neighbors"`
+	Routes    types.RouteStat    `json:"routes"`
+	// Sockets by listening port for tcp, by local port of unconnected
+	// sockets for udp.
 	TcpWithPort  types.TcpStatWithPort `json:"tcpwithport"`
 	Tcp6WithPort types.TcpStatWithPort `json:"tcp6withport"`
+	UdpWithPort  types.UdpStatWithPort `json:"udpwithport"`
+	Udp6WithPort types.UdpStatWithPort `json:"udp6withport"`
+}
+
+type ContainerStats struct {
+	Timestamp time.Time `json:"timestamp"`
+	// NetworkMode is host or container when the network namespace is owned
+	// by the host or another container, in which case only the sockets of
+	// the container are counted.
+	NetworkMode string `json:"network_mode,omitempty"`
+	// Statistics of the network namespace of the container's init process.
+	NetworkStats
+	// EphemeralPorts is the ephemeral port usage of the tcp sockets.
+	EphemeralPorts types.EphemeralPortStat `json:"ephemeralports"`
+	Sysctl         types.SysctlStat        `json:"sysctl"`
+	// Peers are the remote ips and ports with most tcp connections.
+	Peers types.PeerStat `json:"peers"`
+	// TcpTimers counts the tcp sockets waiting on a retransmission or probe.
+	TcpTimers types.TcpTimerStat `json:"tcptimers"`
+	// Churn is nil until the tcp sockets of the container have been read.
+	Churn *types.ConnectionChurnStat `json:"churn,omitempty"`
+	// ConnectionAges are the age histograms of established and close_wait
+	// tcp connections, ages being counted from when they were first seen.
+	ConnectionAges []types.ConnectionAgeStat `json:"connectionages,omitempty"`
+	// Connections are the tcp connections with other containers of the node.
+	Connections []types.ContainerConnections `json:"connections,omitempty"`
+	// ClusterConnections are the tcp connections with kubernetes workloads
+	// outside the node.
+	ClusterConnections []types.ClusterConnections `json:"clusterconnections,omitempty"`
+	// Fds counts the file descriptors of the init process of the container,
+	// or of all its processes with --fd_all_processes.
+	Fds *types.FdStat `json:"fds,omitempty"`
+	// Links maps the interfaces of the container to the ifindex of their
+	// peer, the host side for veths.
+	Links map[string]int `json:"links,omitempty"`
+	// Ipvs, Softnet and Interfaces are only set for the host.
+	Ipvs       *types.IpvsStat       `json:"ipvs,omitempty"`
+	Softnet    []types.SoftnetStat   `json:"softnet,omitempty"`
+	Interfaces []types.InterfaceStat `json:"interfaces,omitempty"`
+	// Statistics of other network namespaces entered by processes of the container.
+	Nested []NetworkStats `json:"nested,omitempty"`
+}
+
+// SharedNetwork tells whether the container lives in a network namespace it
+// does not own.
+func (s *ContainerStats) SharedNetwork() bool {
+	return s.NetworkMode == NetworkModeHost || s.NetworkMode == NetworkModeContainer
 }
@@ -6,22 +6,28 @@ import (
 	"net/http"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
 
+	"github.com/yanqing-exporter/collector/types"
+	"github.com/yanqing-exporter/container/docker"
 	"github.com/yanqing-exporter/storage"
 )
 
 const (
 	containersApi = "containers"
+	hostApi       = "host"
 	apiResource   = "/api/"
+
+	peersResource = "peers"
 )
 
 const (
 	apiRequestType = iota + 1
-	// apiRequestArgs
+	apiRequestArgs
 )
 
 var apiRegexp = regexp.MustCompile(`/api/([^/]+)?(.*)`)
@@ -49,10 +55,11 @@ func handleRequest(ms storage.Storage, w http.ResponseWriter, r *http.Request) e
 		return fmt.Errorf("malformed request %q", request)
 	}
 	requestType := requestElements[apiRequestType]
-	// requestArgs := strings.Split(requestElements[apiRequestArgs], "/")
+	// container names are cgroup paths such as /docker/<id>
+	requestArgs := strings.TrimSuffix(requestElements[apiRequestArgs], "/")
 
 	if requestType == "" {
-		requestTypes := []string{containersApi}
+		requestTypes := []string{containersApi, hostApi}
 		sort.Strings(requestTypes)
 		http.Error(w, fmt.Sprintf("Supported request types: %q", strings.Join(requestTypes, ",")), http.StatusBadRequest)
 		return nil
@@ -60,15 +67,139 @@ func handleRequest(ms storage.Storage, w http.ResponseWriter, r *http.Request) e
 
 	switch requestType {
 	case containersApi:
-		glog.V(4).Infof("Api - Container")
-		containerInfos := ms.GetAllContainerInfo()
-		return writeResult(containerInfos, w)
+		query, err := parseStatsQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+
+		// the whole history of containers by default
+		if query == nil {
+			query = &statsQuery{}
+		}
+
+		if requestArgs == "" {
+			glog.V(4).Infof("Api - Container")
+			containerInfos := ms.GetAllContainerInfo()
+			// the containers of the storage are read-only
+			selected := make(map[string]*docker.ContainerInfo, len(containerInfos))
+			for name, container := range containerInfos {
+				selected[name] = query.apply(ms, container)
+			}
+			return writeResult(selected, w)
+		}
+
+		name := requestArgs
+		isPeers := strings.HasSuffix(name, "/"+peersResource)
+		if isPeers {
+			name = strings.TrimSuffix(name, "/"+peersResource)
+		}
+		container, ok := findContainer(ms, name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown container %q", name), http.StatusNotFound)
+			return nil
+		}
+		if isPeers {
+			glog.V(4).Infof("Api - Container peers %s", container.Name)
+			return writeResult(newContainerPeers(container), w)
+		}
+		glog.V(4).Infof("Api - Container %s", container.Name)
+		return writeResult(query.apply(ms, container), w)
+	case hostApi:
+		glog.V(4).Infof("Api - Host")
+		hostStats := ms.GetHostStats()
+		return writeResult(hostStats, w)
 	default:
 		return fmt.Errorf("unknown request type %q", requestType)
 	}
 	return nil
 }
 
+// findContainer looks a container up by name, alias or id.
+func findContainer(ms storage.Storage, name string) (*docker.ContainerInfo, bool) {
+	if container, err := ms.GetContainerInfo(name); err == nil {
+		return container, true
+	}
+
+	alias := strings.TrimPrefix(name, "/")
+	for _, container := range ms.GetAllContainerInfo() {
+		if container.Id == alias {
+			return container, true
+		}
+		for _, a := range container.Aliases {
+			if a == alias {
+				return container, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// statsQuery selects the stats of containers with the start and end RFC3339
+// times and count parameters.
+type statsQuery struct {
+	start time.Time
+	end   time.Time
+	count int
+}
+
+// parseStatsQuery returns nil when no parameters are given.
+func parseStatsQuery(r *http.Request) (*statsQuery, error) {
+	values := r.URL.Query()
+	if values.Get("start") == "" && values.Get("end") == "" && values.Get("count") == "" {
+		return nil, nil
+	}
+
+	query := &statsQuery{}
+	var err error
+	if s := values.Get("start"); s != "" {
+		if query.start, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return nil, fmt.Errorf("invalid start %q: %v", s, err)
+		}
+	}
+	if s := values.Get("end"); s != "" {
+		if query.end, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return nil, fmt.Errorf("invalid end %q: %v", s, err)
+		}
+	}
+	if s := values.Get("count"); s != "" {
+		if query.count, err = strconv.Atoi(s); err != nil || query.count < 0 {
+			return nil, fmt.Errorf("invalid count %q", s)
+		}
+	}
+	return query, nil
+}
+
+// apply returns a copy of container holding the selected stats only.
+func (q *statsQuery) apply(ms storage.Storage, container *docker.ContainerInfo) *docker.ContainerInfo {
+	stats, err := ms.GetStatsRange(container.Name, q.start, q.end, q.count)
+	if err != nil {
+		// removed since it was listed
+		stats = nil
+	}
+	return &docker.ContainerInfo{
+		ContainerReference: container.ContainerReference,
+		Spec:               container.Spec,
+		Stats:              stats,
+	}
+}
+
+type containerPeers struct {
+	Name      string         `json:"name"`
+	Timestamp time.Time      `json:"timestamp"`
+	Peers     types.PeerStat `json:"peers"`
+}
+
+// newContainerPeers returns the peers of the most recent stats of a container.
+func newContainerPeers(container *docker.ContainerInfo) containerPeers {
+	peers := containerPeers{Name: container.Name}
+	if l := len(container.Stats); l > 0 {
+		peers.Timestamp = container.Stats[l-1].Timestamp
+		peers.Peers = container.Stats[l-1].Peers
+	}
+	return peers
+}
+
 func writeResult(res interface{}, w http.ResponseWriter) error {
 	out, err := json.Marshal(res)
 	if err != nil {
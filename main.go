@@ -3,15 +3,22 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/yanqing-exporter/collector"
 	"github.com/yanqing-exporter/collector/cadvisor"
 	yanqinghttp "github.com/yanqing-exporter/http"
+	"github.com/yanqing-exporter/metrics"
+	"github.com/yanqing-exporter/remotewrite"
 	"github.com/yanqing-exporter/storage"
 )
 
@@ -20,6 +27,22 @@ var listenPort = flag.Int("port", 9187, "listen port")
 var cadvisorListenPort = flag.Int("cadvisor_port", 8080, "listen port for cadvisor")
 var prometheusEndpoint = flag.String("prometheus_endpoint", "/metrics", "Endpoint to expose Prometheus metrics on")
 var maxStatsLength = flag.Int("max_stats_length", 5, "maximal length of stats to store")
+var storageMemoryBudget = flag.Int64("storage_memory_budget", 0, "Size in bytes of the stats kept in memory, history, latest stats and aggregation windows included, the oldest stats of the least recently updated containers being evicted beyond it, 0 for no limit")
+var aggregationWindow = flag.Duration("aggregation_window", 0, "Window of the min, max and avg of gauges exported as _over_window series, usually the scrape interval, 0 to disable")
+var storageDriver = flag.String("storage_driver", "memory", "Storage of the stats, memory or disk to keep them across restarts")
+var storageDir = flag.String("storage_dir", "/var/lib/yanqing-exporter", "Directory of the disk storage")
+var storageRetentionAge = flag.Duration("storage_retention_age", 24*time.Hour, "Age of the stats kept by the disk storage, 0 for no limit")
+var storageRetentionSize = flag.Int64("storage_retention_size", 256*1024*1024, "Size in bytes of the stats kept by the disk storage, 0 for no limit")
+var remoteWriteUrl = flag.String("remote_write_url", "", "Prometheus remote write endpoint to push the metrics to after every collection, for nodes which can not be scraped, disabled if empty")
+var remoteWriteUsername = flag.String("remote_write_username", "", "Username of the basic auth of the remote write endpoint")
+var remoteWritePasswordFile = flag.String("remote_write_password_file", "", "File holding the password of the basic auth of the remote write endpoint")
+var remoteWriteBearerTokenFile = flag.String("remote_write_bearer_token_file", "", "File holding the bearer token of the remote write endpoint")
+var remoteWriteTimeout = flag.Duration("remote_write_timeout", 30*time.Second, "Timeout of the requests to the remote write endpoint")
+var remoteWriteBatchSize = flag.Int("remote_write_batch_size", 500, "Number of series pushed per request to the remote write endpoint")
+var remoteWriteQueueCapacity = flag.Int("remote_write_queue_capacity", 100000, "Number of series queued while the remote write endpoint is unreachable, the oldest being dropped beyond it")
+var remoteWriteMinBackoff = flag.Duration("remote_write_min_backoff", 100*time.Millisecond, "Initial delay before retrying a failed request to the remote write endpoint")
+var remoteWriteMaxBackoff = flag.Duration("remote_write_max_backoff", 10*time.Second, "Maximal delay before retrying a failed request to the remote write endpoint")
+var remoteWriteExternalLabels = flag.String("remote_write_external_labels", "", "Comma separated name=value labels added to every series pushed to the remote write endpoint, instance defaulting to the host ip")
 
 func main() {
 	flag.Parse()
@@ -31,7 +54,14 @@ func main() {
 
 	glog.Infof("host ip is %s", hostIp)
 
-	memoryStorage := storage.New(*maxStatsLength)
+	memoryStorage, err := newStorage()
+	if err != nil {
+		glog.Errorf("Failed to create storage: %v", err)
+		os.Exit(1)
+	}
+	if closer, ok := memoryStorage.(io.Closer); ok {
+		go closeOnSignal(closer)
+	}
 
 	cadvisorClient, err := cadvisor.New(hostIp, *cadvisorListenPort)
 	if nil != err {
@@ -39,8 +69,20 @@ func main() {
 		os.Exit(1)
 	}
 
-	metricsCollector, err := collector.NewCollector(memoryStorage, cadvisorClient)
+	var sinks []collector.Sink
+	if *remoteWriteUrl != "" {
+		remoteWriter, err := newRemoteWriter(memoryStorage, hostIp)
+		if err != nil {
+			glog.Errorf("Failed to create remote writer: %v", err)
+			os.Exit(1)
+		}
+		remoteWriter.Start()
+		sinks = append(sinks, remoteWriter)
+	}
+
+	metricsCollector, err := collector.NewCollector(memoryStorage, cadvisorClient, sinks...)
 	if nil != err {
+		glog.Errorf("Failed to create collector: %v", err)
 		os.Exit(1)
 	}
 
@@ -57,6 +99,60 @@ func main() {
 	glog.Fatal(http.ListenAndServe(server, mux))
 }
 
+// newStorage creates the storage selected by --storage_driver, the disk
+// storage restoring the stats of the previous run.
+func newStorage() (storage.Storage, error) {
+	switch *storageDriver {
+	case "memory":
+		return storage.New(*maxStatsLength, *storageMemoryBudget, *aggregationWindow, metrics.WindowValues), nil
+	case "disk":
+		return storage.NewDiskStorage(*storageDir, *maxStatsLength, *storageMemoryBudget, *aggregationWindow, metrics.WindowValues, *storageRetentionAge, *storageRetentionSize)
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", *storageDriver)
+}
+
+// closeOnSignal closes the storage when the exporter is stopped, the disk
+// storage saving the stats it only holds in memory.
+func closeOnSignal(closer io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+	if err := closer.Close(); err != nil {
+		glog.Errorf("Failed to close storage: %v", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// newRemoteWriter creates a writer pushing the series of the metrics
+// collector, as exposed on the prometheus endpoint, labelled with the
+// instance they come from.
+func newRemoteWriter(memoryStorage storage.Storage, hostIp net.IP) (*remotewrite.Writer, error) {
+	externalLabels, err := remotewrite.ParseExternalLabels(*remoteWriteExternalLabels)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := externalLabels["instance"]; !ok {
+		externalLabels["instance"] = hostIp.String()
+	}
+	r := prometheus.NewRegistry()
+	if err := r.Register(metrics.NewCollector(memoryStorage)); err != nil {
+		return nil, err
+	}
+	return remotewrite.NewWriter(r, remotewrite.Config{
+		URL:             *remoteWriteUrl,
+		Username:        *remoteWriteUsername,
+		PasswordFile:    *remoteWritePasswordFile,
+		BearerTokenFile: *remoteWriteBearerTokenFile,
+		Timeout:         *remoteWriteTimeout,
+		BatchSize:       *remoteWriteBatchSize,
+		QueueCapacity:   *remoteWriteQueueCapacity,
+		MinBackoff:      *remoteWriteMinBackoff,
+		MaxBackoff:      *remoteWriteMaxBackoff,
+		ExternalLabels:  externalLabels,
+	})
+}
+
 func parseHostIp(s string) (net.IP, error) {
 	ip := net.ParseIP(s)
 
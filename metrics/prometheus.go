@@ -1,12 +1,17 @@
 package metrics
 
 import (
+	"flag"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	info "github.com/google/cadvisor/info/v1"
 	"github.com/google/cadvisor/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/yanqing-exporter/collector/types"
 	"github.com/yanqing-exporter/container/docker"
 	"github.com/yanqing-exporter/storage"
 )
@@ -18,10 +23,35 @@ const (
 	ContainerLabelPodNamespace     = ContainerKubernetesPrefix + "pod.namespace"
 	ContainerLabelPodName          = ContainerKubernetesPrefix + "pod.name"
 	ContainerLabelApp              = "app"
+
+	containerMetricPrefix = "yq_container_"
+	hostMetricPrefix      = "yq_host_"
 )
 
 var (
+	peerMetricsTopN = flag.Int("peer_metrics_top_n", 0, "Number of remote ips with most tcp connections to export per container, at most peers_top_n, 0 to disable")
+
 	yanqingScropedLastSeenDesc = prometheus.NewDesc("yanqing_scroped_last_seen", "yanqing_scroped_last_seen Last timstamp when scroped.", nil, nil)
+	yqContainerConnectionsDesc = prometheus.NewDesc("yq_container_connections", "tcp connections between containers of the node by yanqing-exporter", []string{"src_container", "dst_container", "state"}, nil)
+	ipvsBackendLabels          = []string{"protocol", "virtual_address", "virtual_port", "backend_address", "backend_port", "container", "pod_name", "namespace"}
+	yqIpvsConnectionsDesc      = prometheus.NewDesc("yq_host_ipvs_connections_total", "connections handled by ipvs on the host by yanqing-exporter", nil, nil)
+	yqIpvsPacketsDesc          = prometheus.NewDesc("yq_host_ipvs_packets_total", "packets handled by ipvs on the host by yanqing-exporter", []string{"direction"}, nil)
+	yqIpvsBytesDesc            = prometheus.NewDesc("yq_host_ipvs_bytes_total", "bytes handled by ipvs on the host by yanqing-exporter", []string{"direction"}, nil)
+	yqIpvsServiceStateDesc     = prometheus.NewDesc("yq_host_ipvs_service_connections", "ipvs connections of a virtual service by state by yanqing-exporter", []string{"protocol", "virtual_address", "virtual_port", "conn_state"}, nil)
+	yqIpvsBackendDesc          = prometheus.NewDesc("yq_host_ipvs_backend_connections", "active and inactive ipvs connections of a real server by yanqing-exporter, labelled with the container of the node owning its ip", append(ipvsBackendLabels, "state"), nil)
+	yqIpvsBackendWeightDesc    = prometheus.NewDesc("yq_host_ipvs_backend_weight", "weight of an ipvs real server by yanqing-exporter, labelled with the container of the node owning its ip", ipvsBackendLabels, nil)
+	interfaceLabels            = []string{"interface", "direction", "container", "pod_name", "namespace"}
+	yqInterfaceDropsDesc       = prometheus.NewDesc("yq_host_interface_drops_total", "packets dropped by a host interface by yanqing-exporter, labelled with the container of veths", interfaceLabels, nil)
+	yqInterfaceErrorsDesc      = prometheus.NewDesc("yq_host_interface_errors_total", "errors of a host interface by yanqing-exporter, labelled with the container of veths", interfaceLabels, nil)
+	yqInterfacePacketsDesc     = prometheus.NewDesc("yq_host_interface_packets_total", "packets of a host interface by yanqing-exporter, labelled with the container of veths", interfaceLabels, nil)
+	yqSoftnetProcessedDesc     = prometheus.NewDesc("yq_host_softnet_processed_total", "packets processed by the backlog of a cpu by yanqing-exporter", []string{"cpu"}, nil)
+	yqSoftnetDroppedDesc       = prometheus.NewDesc("yq_host_softnet_dropped_total", "packets dropped by the backlog of a cpu, as netdev_max_backlog was exceeded, by yanqing-exporter", []string{"cpu"}, nil)
+	yqSoftnetTimeSqueezeDesc   = prometheus.NewDesc("yq_host_softnet_time_squeeze_total", "times the packet processing of a cpu ran out of budget with work remaining by yanqing-exporter", []string{"cpu"}, nil)
+	yqStorageBytesDesc         = prometheus.NewDesc("yq_storage_bytes", "memory used by the stats of yanqing-exporter, history, latest stats and aggregation windows included", nil, nil)
+	yqStorageBudgetDesc        = prometheus.NewDesc("yq_storage_budget_bytes", "memory budget of the stats of yanqing-exporter, 0 for no limit", nil, nil)
+	yqStorageSamplesDesc       = prometheus.NewDesc("yq_storage_samples", "stats samples kept in the history of yanqing-exporter", nil, nil)
+	yqStorageEvictedDesc       = prometheus.NewDesc("yq_storage_evicted_samples_total", "stats samples evicted from the history of yanqing-exporter to fit in its memory budget", nil, nil)
+	yqClusterConnectionsDesc   = prometheus.NewDesc("yq_container_cluster_connections", "tcp connections of containers with kubernetes workloads outside the node by yanqing-exporter", []string{"src_container", "dst_kind", "dst_namespace", "dst_name", "state"}, nil)
 	contaierLabelIgnore        = map[string]bool{
 		ContainerKubernetesPrefix + "container.logpath": true,
 		ContainerKubernetesPrefix + "sandbox.id":        true,
@@ -35,6 +65,15 @@ type metricValue struct {
 
 type metricValues []metricValue
 
+type metricHistogram struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+	labels  []string
+}
+
+type metricHistograms []metricHistogram
+
 type ContainerLabelsFunc func(*docker.ContainerInfo) map[string]string
 
 type containerMetric struct {
@@ -42,11 +81,162 @@ type containerMetric struct {
 	help        string
 	valueType   prometheus.ValueType
 	extraLabels []string
-	getValues   func(s *docker.ContainerStats) metricValues
+	// netnsWide metrics describe the whole network namespace and can not be
+	// attributed to the processes owning sockets in it.
+	netnsWide bool
+	// windowed gauges are also exported as their min, max and avg over the
+	// aggregation window of the storage, so that bursts between scrapes are
+	// not missed.
+	windowed  bool
+	getValues func(s *docker.ContainerStats) metricValues
+	// getHistograms replaces getValues for histograms.
+	getHistograms func(s *docker.ContainerStats) metricHistograms
+}
+
+// collect sends the metrics of stats, labelled with values.
+func (cm *containerMetric) collect(ch chan<- prometheus.Metric, desc *prometheus.Desc, stats *docker.ContainerStats, values []string) {
+	if cm.getHistograms != nil {
+		for _, h := range cm.getHistograms(stats) {
+			ch <- prometheus.MustNewConstHistogram(desc, h.count, h.sum, h.buckets, append(values, h.labels...)...)
+		}
+		return
+	}
+	for _, metricValue := range cm.getValues(stats) {
+		ch <- prometheus.MustNewConstMetric(desc, cm.valueType, float64(metricValue.value), append(values, metricValue.labels...)...)
+	}
+}
+
+// windowMetric describes the aggregation of the metric over the window, e.g.
+// yq_container_fds_max_over_window for yq_container_fds.
+func (cm *containerMetric) windowMetric(aggregation string) *containerMetric {
+	return &containerMetric{
+		name:        cm.name + "_" + aggregation + "_over_window",
+		help:        aggregation + " over the aggregation window of the " + cm.help,
+		valueType:   prometheus.GaugeValue,
+		extraLabels: cm.extraLabels,
+	}
+}
+
+// collectWindow sends the min, max and avg of the metric over the window
+// from the aggregates of its series, labelled with values.
+func (cm *containerMetric) collectWindow(ch chan<- prometheus.Metric, desc func(wm *containerMetric) *prometheus.Desc, aggregates []storage.WindowAggregate, values []string) {
+	if len(aggregates) == 0 {
+		return
+	}
+	minDesc, maxDesc, avgDesc := desc(cm.windowMetric("min")), desc(cm.windowMetric("max")), desc(cm.windowMetric("avg"))
+	for _, a := range aggregates {
+		labels := append(append([]string{}, values...), a.Labels...)
+		ch <- prometheus.MustNewConstMetric(minDesc, prometheus.GaugeValue, a.Min, labels...)
+		ch <- prometheus.MustNewConstMetric(maxDesc, prometheus.GaugeValue, a.Max, labels...)
+		ch <- prometheus.MustNewConstMetric(avgDesc, prometheus.GaugeValue, a.Sum/float64(a.Count), labels...)
+	}
+}
+
+// aggregatesByMetric groups the window aggregates by the name of their metric.
+func aggregatesByMetric(aggregates []storage.WindowAggregate) map[string][]storage.WindowAggregate {
+	byMetric := make(map[string][]storage.WindowAggregate)
+	for _, a := range aggregates {
+		byMetric[a.Metric] = append(byMetric[a.Metric], a)
+	}
+	return byMetric
 }
 
 func (cm *containerMetric) desc(baseLabels []string) *prometheus.Desc {
-	return prometheus.NewDesc(cm.name, cm.help, append(baseLabels, cm.extraLabels...), nil)
+	// the desc keeps the labels, which must not share the array of baseLabels
+	labels := append(append(make([]string, 0, len(baseLabels)+len(cm.extraLabels)), baseLabels...), cm.extraLabels...)
+	return prometheus.NewDesc(cm.name, cm.help, labels, nil)
+}
+
+// hostDesc describes the metric for the host network namespace, e.g.
+// yq_host_network_tcp_usage_total for yq_container_network_tcp_usage_total.
+// Metrics which are not about containers have no host counterpart.
+func (cm *containerMetric) hostDesc() *prometheus.Desc {
+	if !strings.HasPrefix(cm.name, containerMetricPrefix) {
+		return nil
+	}
+	name := hostMetricPrefix + strings.TrimPrefix(cm.name, containerMetricPrefix)
+	return prometheus.NewDesc(name, cm.help, append([]string{"target"}, cm.extraLabels...), nil)
+}
+
+// networkValues applies getValues to every network namespace of the container,
+// appending a netns label which is empty for the namespace of its init process
+// so those series keep their identity, and the inode for nested namespaces.
+func networkValues(getValues func(s *docker.NetworkStats) metricValues) func(s *docker.ContainerStats) metricValues {
+	return func(s *docker.ContainerStats) metricValues {
+		values := metricValues{}
+		for _, v := range getValues(&s.NetworkStats) {
+			values = append(values, metricValue{value: v.value, labels: append(v.labels, "")})
+		}
+		for i := range s.Nested {
+			netns := strconv.FormatUint(s.Nested[i].Netns, 10)
+			for _, v := range getValues(&s.Nested[i]) {
+				values = append(values, metricValue{value: v.value, labels: append(v.labels, netns)})
+			}
+		}
+		return values
+	}
+}
+
+// datagramMetric describes the raw or ping sockets of protocol like udp ones,
+// e.g. yq_container_network_raw_usage_total with a raw_state label.
+func datagramMetric(protocol string, getStats func(s *docker.NetworkStats) info.UdpStat) containerMetric {
+	return containerMetric{
+		name:        "yq_container_network_" + protocol + "_usage_total",
+		help:        protocol + " socket usage statistic for container by yanqing-exporter",
+		valueType:   prometheus.GaugeValue,
+		windowed:    true,
+		extraLabels: []string{protocol + "_state", "netns"},
+		getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+			stats := getStats(s)
+			return metricValues{
+				{
+					value:  float64(stats.Listen),
+					labels: []string{"listen"},
+				},
+				{
+					value:  float64(stats.Dropped),
+					labels: []string{"dropped"},
+				},
+				{
+					value:  float64(stats.RxQueued),
+					labels: []string{"rxqueued"},
+				},
+				{
+					value:  float64(stats.TxQueued),
+					labels: []string{"txqueued"},
+				},
+			}
+		}),
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// udpPortValues applies getValues to the udp and udp6 ports of a network
+// namespace, appending protocol and udp_port labels.
+func udpPortValues(getValues func(p types.UdpPortStat) metricValues) func(s *docker.NetworkStats) metricValues {
+	return func(s *docker.NetworkStats) metricValues {
+		values := metricValues{}
+		for _, proto := range []struct {
+			name  string
+			stats types.UdpStatWithPort
+		}{
+			{"udp", s.UdpWithPort},
+			{"udp6", s.Udp6WithPort},
+		} {
+			for port, portStats := range proto.stats.Stats {
+				for _, v := range getValues(portStats) {
+					values = append(values, metricValue{value: v.value, labels: append(v.labels, proto.name, strconv.FormatInt(port, 10))})
+				}
+			}
+		}
+		return values
+	}
 }
 
 type yanqingCollector struct {
@@ -58,293 +248,850 @@ type yanqingCollector struct {
 func NewCollector(memoryStorage storage.Storage) *yanqingCollector {
 	return &yanqingCollector{
 		containerLabelsFunc: DefaultLabels,
-		containerMetrics: []containerMetric{
-			{
-				name:      "yanqing_last_seen",
-				help:      "Last time was seen by the yanqing-exporter",
-				valueType: prometheus.GaugeValue,
-				getValues: func(s *docker.ContainerStats) metricValues {
-					return metricValues{{value: float64(time.Now().Unix())}}
-				},
+		containerMetrics:    newContainerMetrics(),
+		cacheStorage:        memoryStorage,
+	}
+}
+
+// windowedMetrics are the metrics whose values are aggregated by the storage.
+var windowedMetrics = func() []containerMetric {
+	var windowed []containerMetric
+	for _, cm := range newContainerMetrics() {
+		if cm.windowed {
+			windowed = append(windowed, cm)
+		}
+	}
+	return windowed
+}()
+
+// WindowValues returns the values of the windowed metrics of stats, to be
+// aggregated by the storage over its aggregation window.
+func WindowValues(stats *docker.ContainerStats) []storage.WindowValue {
+	var values []storage.WindowValue
+	for _, cm := range windowedMetrics {
+		for _, v := range cm.getValues(stats) {
+			values = append(values, storage.WindowValue{Metric: cm.name, Labels: v.labels, Value: v.value})
+		}
+	}
+	return values
+}
+
+func newContainerMetrics() []containerMetric {
+	return []containerMetric{
+		{
+			name:      "yanqing_last_seen",
+			help:      "Last time was seen by the yanqing-exporter",
+			valueType: prometheus.GaugeValue,
+			getValues: func(s *docker.ContainerStats) metricValues {
+				return metricValues{{value: float64(time.Now().Unix())}}
 			},
-			{
-				name:      "yq_container_timestamp",
-				help:      "statistic timestamp",
-				valueType: prometheus.GaugeValue,
-				getValues: func(s *docker.ContainerStats) metricValues {
-					return metricValues{{value: float64(s.Timestamp.Unix())}}
-				},
+		},
+		{
+			name:      "yq_container_timestamp",
+			help:      "statistic timestamp",
+			valueType: prometheus.GaugeValue,
+			getValues: func(s *docker.ContainerStats) metricValues {
+				return metricValues{{value: float64(s.Timestamp.Unix())}}
 			},
-			{
-				name:        "yq_container_network_tcp_usage_total",
-				help:        "tcp connection usage statistic for container by yanqing-exporter",
-				valueType:   prometheus.GaugeValue,
-				extraLabels: []string{"tcp_state"},
-				getValues: func(s *docker.ContainerStats) metricValues {
-					return metricValues{
-						{
-							value:  float64(s.Tcp.Established),
-							labels: []string{"established"},
-						},
-						{
-							value:  float64(s.Tcp.SynSent),
-							labels: []string{"synsent"},
-						},
-						{
-							value:  float64(s.Tcp.SynRecv),
-							labels: []string{"synrecv"},
-						},
-						{
-							value:  float64(s.Tcp.FinWait1),
-							labels: []string{"finwait1"},
-						},
-						{
-							value:  float64(s.Tcp.FinWait2),
-							labels: []string{"finwait2"},
-						},
-						{
-							value:  float64(s.Tcp.TimeWait),
-							labels: []string{"timewait"},
-						},
-						{
-							value:  float64(s.Tcp.Close),
-							labels: []string{"close"},
-						},
-						{
-							value:  float64(s.Tcp.CloseWait),
-							labels: []string{"closewait"},
-						},
-						{
-							value:  float64(s.Tcp.LastAck),
-							labels: []string{"lastack"},
-						},
-						{
-							value:  float64(s.Tcp.Listen),
-							labels: []string{"listen"},
-						},
-						{
-							value:  float64(s.Tcp.Closing),
-							labels: []string{"closing"},
-						},
-					}
-				},
-			}, {
-				name:        "yq_container_network_udp_usage_total",
-				help:        "udp connection usage statistic for container by yanqing-exporter",
-				valueType:   prometheus.GaugeValue,
-				extraLabels: []string{"udp_state"},
-				getValues: func(s *docker.ContainerStats) metricValues {
-					return metricValues{
-						{
-							value:  float64(s.Udp.Listen),
-							labels: []string{"listen"},
-						},
-						{
-							value:  float64(s.Udp.Dropped),
-							labels: []string{"dropped"},
-						},
-						{
-							value:  float64(s.Udp.RxQueued),
-							labels: []string{"rxqueued"},
-						},
-						{
-							value:  float64(s.Udp.TxQueued),
-							labels: []string{"txqueued"},
-						},
-					}
-				},
+		},
+		{
+			name:        "yq_container_network_tcp_usage_total",
+			help:        "tcp connection usage statistic for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"tcp_state", "netns"},
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				return metricValues{
+					{
+						value:  float64(s.Tcp.Established),
+						labels: []string{"established"},
+					},
+					{
+						value:  float64(s.Tcp.SynSent),
+						labels: []string{"synsent"},
+					},
+					{
+						value:  float64(s.Tcp.SynRecv),
+						labels: []string{"synrecv"},
+					},
+					{
+						value:  float64(s.Tcp.FinWait1),
+						labels: []string{"finwait1"},
+					},
+					{
+						value:  float64(s.Tcp.FinWait2),
+						labels: []string{"finwait2"},
+					},
+					{
+						value:  float64(s.Tcp.TimeWait),
+						labels: []string{"timewait"},
+					},
+					{
+						value:  float64(s.Tcp.Close),
+						labels: []string{"close"},
+					},
+					{
+						value:  float64(s.Tcp.CloseWait),
+						labels: []string{"closewait"},
+					},
+					{
+						value:  float64(s.Tcp.LastAck),
+						labels: []string{"lastack"},
+					},
+					{
+						value:  float64(s.Tcp.Listen),
+						labels: []string{"listen"},
+					},
+					{
+						value:  float64(s.Tcp.Closing),
+						labels: []string{"closing"},
+					},
+				}
+			}),
+		}, {
+			name:        "yq_container_network_udp_usage_total",
+			help:        "udp connection usage statistic for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"udp_state", "netns"},
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				return metricValues{
+					{
+						value:  float64(s.Udp.Listen),
+						labels: []string{"listen"},
+					},
+					{
+						value:  float64(s.Udp.Dropped),
+						labels: []string{"dropped"},
+					},
+					{
+						value:  float64(s.Udp.RxQueued),
+						labels: []string{"rxqueued"},
+					},
+					{
+						value:  float64(s.Udp.TxQueued),
+						labels: []string{"txqueued"},
+					},
+				}
+			}),
+		},
+		{
+			name:        "yq_container_network_tcp6_usage_total",
+			help:        "tcp6 connection usage statistic for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"tcp6_state", "netns"},
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				return metricValues{
+					{
+						value:  float64(s.Tcp6.Established),
+						labels: []string{"established"},
+					},
+					{
+						value:  float64(s.Tcp6.SynSent),
+						labels: []string{"synsent"},
+					},
+					{
+						value:  float64(s.Tcp6.SynRecv),
+						labels: []string{"synrecv"},
+					},
+					{
+						value:  float64(s.Tcp6.FinWait1),
+						labels: []string{"finwait1"},
+					},
+					{
+						value:  float64(s.Tcp6.FinWait2),
+						labels: []string{"finwait2"},
+					},
+					{
+						value:  float64(s.Tcp6.TimeWait),
+						labels: []string{"timewait"},
+					},
+					{
+						value:  float64(s.Tcp6.Close),
+						labels: []string{"close"},
+					},
+					{
+						value:  float64(s.Tcp6.CloseWait),
+						labels: []string{"closewait"},
+					},
+					{
+						value:  float64(s.Tcp6.LastAck),
+						labels: []string{"lastack"},
+					},
+					{
+						value:  float64(s.Tcp6.Listen),
+						labels: []string{"listen"},
+					},
+					{
+						value:  float64(s.Tcp6.Closing),
+						labels: []string{"closing"},
+					},
+				}
+			}),
+		}, {
+			name:        "yq_container_network_udp6_usage_total",
+			help:        "udp6 connection usage statistic for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"udp6_state", "netns"},
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				return metricValues{
+					{
+						value:  float64(s.Udp6.Listen),
+						labels: []string{"listen"},
+					},
+					{
+						value:  float64(s.Udp6.Dropped),
+						labels: []string{"dropped"},
+					},
+					{
+						value:  float64(s.Udp6.RxQueued),
+						labels: []string{"rxqueued"},
+					},
+					{
+						value:  float64(s.Udp6.TxQueued),
+						labels: []string{"txqueued"},
+					},
+				}
+			}),
+		},
+		datagramMetric("raw", func(s *docker.NetworkStats) info.UdpStat { return s.Raw }),
+		datagramMetric("raw6", func(s *docker.NetworkStats) info.UdpStat { return s.Raw6 }),
+		datagramMetric("icmp", func(s *docker.NetworkStats) info.UdpStat { return s.Icmp }),
+		datagramMetric("icmp6", func(s *docker.NetworkStats) info.UdpStat { return s.Icmp6 }),
+		{
+			name:        "yq_container_network_tcpext_usage_total",
+			help:        "tcpext usage statistic for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			extraLabels: []string{"tcpext_state", "netns"},
+			netnsWide:   true,
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				return metricValues{
+					{
+						value:  float64(s.TcpExt.PruneCalled),
+						labels: []string{"pruneCalled"},
+					},
+					{
+						value:  float64(s.TcpExt.LockDroppedIcmps),
+						labels: []string{"lockdroppedicmps"},
+					},
+					{
+						value:  float64(s.TcpExt.ArpFilter),
+						labels: []string{"arpfilter"},
+					},
+					{
+						value:  float64(s.TcpExt.TW),
+						labels: []string{"tw"},
+					},
+					{
+						value:  float64(s.TcpExt.DelayedACKLocked),
+						labels: []string{"delayedacklocked"},
+					},
+					{
+						value:  float64(s.TcpExt.ListenOverflows),
+						labels: []string{"listenoverflows"},
+					},
+					{
+						value:  float64(s.TcpExt.ListenDrops),
+						labels: []string{"listendrops"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPPrequeueDropped),
+						labels: []string{"tcpprequeuedropped"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPTSReorder),
+						labels: []string{"tcptsreorder"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPDSACKUndo),
+						labels: []string{"tcpdsackundo"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPLostRetransmit),
+						labels: []string{"tcplostretransmit"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPLossFailures),
+						labels: []string{"tcplossfailures"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPFastRetrans),
+						labels: []string{"tcpfastretrans"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPTimeouts),
+						labels: []string{"tcptimeouts"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPSchedulerFailed),
+						labels: []string{"tcpschedulerfailed"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPAbortOnMemory),
+						labels: []string{"tcpabortonmemory"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPAbortOnTimeout),
+						labels: []string{"tcpabortontimeout"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPAbortFailed),
+						labels: []string{"tcpabortfailed"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPMemoryPressures),
+						labels: []string{"tcpmemorypressures"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPSpuriousRTOs),
+						labels: []string{"tcpspuriousrtos"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPBacklogDrop),
+						labels: []string{"tcpbacklogdrop"},
+					},
+					{
+						value:  float64(s.TcpExt.TCPMinTTLDrop),
+						labels: []string{"tcpminttldrop"},
+					},
+				}
+			}),
+		},
+		{
+			name:        "yq_container_network_sctp_usage_total",
+			help:        "sctp association usage statistic for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"sctp_state", "netns"},
+			netnsWide:   true,
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				return metricValues{
+					{
+						value:  float64(s.Sctp.Closed),
+						labels: []string{"closed"},
+					},
+					{
+						value:  float64(s.Sctp.CookieWait),
+						labels: []string{"cookiewait"},
+					},
+					{
+						value:  float64(s.Sctp.CookieEchoed),
+						labels: []string{"cookieechoed"},
+					},
+					{
+						value:  float64(s.Sctp.Established),
+						labels: []string{"established"},
+					},
+					{
+						value:  float64(s.Sctp.ShutdownPending),
+						labels: []string{"shutdownpending"},
+					},
+					{
+						value:  float64(s.Sctp.ShutdownSent),
+						labels: []string{"shutdownsent"},
+					},
+					{
+						value:  float64(s.Sctp.ShutdownReceived),
+						labels: []string{"shutdownreceived"},
+					},
+					{
+						value:  float64(s.Sctp.ShutdownAckSent),
+						labels: []string{"shutdownacksent"},
+					},
+				}
+			}),
+		}, {
+			name:        "yq_container_network_sctp_endpoint_total",
+			help:        "sctp endpoint count for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			extraLabels: []string{"netns"},
+			netnsWide:   true,
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				return metricValues{{value: float64(s.Sctp.Endpoints)}}
+			}),
+		}, {
+			name:        "yq_container_network_sctpsnmp_usage_total",
+			help:        "sctp snmp statistic for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			extraLabels: []string{"sctpsnmp_state", "netns"},
+			netnsWide:   true,
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				return metricValues{
+					{
+						value:  float64(s.SctpSnmp.SctpCurrEstab),
+						labels: []string{"sctpcurrestab"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpActiveEstabs),
+						labels: []string{"sctpactiveestabs"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpPassiveEstabs),
+						labels: []string{"sctppassiveestabs"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpAborteds),
+						labels: []string{"sctpaborteds"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpShutdowns),
+						labels: []string{"sctpshutdowns"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpOutOfBlues),
+						labels: []string{"sctpoutofblues"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpChecksumErrors),
+						labels: []string{"sctpchecksumerrors"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpT1InitExpireds),
+						labels: []string{"sctpt1initexpireds"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpT1CookieExpireds),
+						labels: []string{"sctpt1cookieexpireds"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpT2ShutdownExpireds),
+						labels: []string{"sctpt2shutdownexpireds"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpT3RtxExpireds),
+						labels: []string{"sctpt3rtxexpireds"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpT4RtoExpireds),
+						labels: []string{"sctpt4rtoexpireds"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpT3Retransmits),
+						labels: []string{"sctpt3retransmits"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpFastRetransmits),
+						labels: []string{"sctpfastretransmits"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpInPktDiscards),
+						labels: []string{"sctpinpktdiscards"},
+					},
+					{
+						value:  float64(s.SctpSnmp.SctpInDataChunkDiscards),
+						labels: []string{"sctpindatachunkdiscards"},
+					},
+				}
+			}),
+		},
+		{
+			name:        "yq_container_network_udp_port_dropped_total",
+			help:        "udp packets dropped by the unconnected sockets of a local port for container by yanqing-exporter",
+			valueType:   prometheus.CounterValue,
+			extraLabels: []string{"protocol", "udp_port", "netns"},
+			getValues: networkValues(udpPortValues(func(p types.UdpPortStat) metricValues {
+				return metricValues{{value: float64(p.Dropped)}}
+			})),
+		},
+		{
+			name:        "yq_container_network_udp_port_queue_bytes",
+			help:        "udp bytes queued by the unconnected sockets of a local port for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"queue", "protocol", "udp_port", "netns"},
+			getValues: networkValues(udpPortValues(func(p types.UdpPortStat) metricValues {
+				return metricValues{
+					{
+						value:  float64(p.RxQueued),
+						labels: []string{"rx"},
+					},
+					{
+						value:  float64(p.TxQueued),
+						labels: []string{"tx"},
+					},
+				}
+			})),
+		},
+		{
+			name:        "yq_container_network_udp_port_rx_queue_utilization",
+			help:        "highest udp rx queue of the unconnected sockets of a local port as a fraction of net.core.rmem_default for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"protocol", "udp_port", "netns"},
+			getValues: networkValues(udpPortValues(func(p types.UdpPortStat) metricValues {
+				return metricValues{{value: p.RxQueueUtilization}}
+			})),
+		},
+		{
+			name:        "yq_container_network_neighbors",
+			help:        "arp entries by interface and state for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			extraLabels: []string{"interface", "neighbor_state", "netns"},
+			netnsWide:   true,
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				values := metricValues{}
+				for _, n := range s.Neighbors.Neighbors {
+					values = append(values, metricValue{
+						value:  float64(n.Count),
+						labels: []string{n.Interface, n.State},
+					})
+				}
+				return values
+			}),
+		},
+		{
+			name:        "yq_container_network_routes",
+			help:        "usable routes for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			extraLabels: []string{"family", "netns"},
+			netnsWide:   true,
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				values := metricValues{{value: float64(s.Routes.Routes), labels: []string{"ipv4"}}}
+				if s.Routes.Ipv6 {
+					values = append(values, metricValue{value: float64(s.Routes.Routes6), labels: []string{"ipv6"}})
+				}
+				return values
+			}),
+		},
+		{
+			name:        "yq_container_network_default_route",
+			help:        "whether a default route exists for container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			extraLabels: []string{"family", "netns"},
+			netnsWide:   true,
+			getValues: networkValues(func(s *docker.NetworkStats) metricValues {
+				values := metricValues{{value: boolValue(s.Routes.DefaultRoute), labels: []string{"ipv4"}}}
+				if s.Routes.Ipv6 {
+					values = append(values, metricValue{value: boolValue(s.Routes.DefaultRoute6), labels: []string{"ipv6"}})
+				}
+				return values
+			}),
+		},
+		{
+			name:      "yq_container_network_ephemeral_port_utilization",
+			help:      "highest ratio of the ephemeral port range used towards a single remote ip and port for container by yanqing-exporter",
+			valueType: prometheus.GaugeValue,
+			windowed:  true,
+			netnsWide: true,
+			getValues: func(s *docker.ContainerStats) metricValues {
+				return metricValues{{value: s.EphemeralPorts.MaxUtilization}}
+			},
+		}, {
+			name:      "yq_container_network_ephemeral_port_used",
+			help:      "highest number of ephemeral ports used towards a single remote ip and port for container by yanqing-exporter",
+			valueType: prometheus.GaugeValue,
+			windowed:  true,
+			netnsWide: true,
+			getValues: func(s *docker.ContainerStats) metricValues {
+				return metricValues{{value: float64(s.EphemeralPorts.MaxUsed)}}
+			},
+		}, {
+			name:      "yq_container_network_ephemeral_port_available",
+			help:      "size of the ephemeral port range for container by yanqing-exporter",
+			valueType: prometheus.GaugeValue,
+			netnsWide: true,
+			getValues: func(s *docker.ContainerStats) metricValues {
+				return metricValues{{value: float64(s.EphemeralPorts.Available)}}
 			},
-			{
-				name:        "yq_container_network_tcp6_usage_total",
-				help:        "tcp6 connection usage statistic for container by yanqing-exporter",
-				valueType:   prometheus.GaugeValue,
-				extraLabels: []string{"tcp6_state"},
-				getValues: func(s *docker.ContainerStats) metricValues {
-					return metricValues{
-						{
-							value:  float64(s.Tcp6.Established),
-							labels: []string{"established"},
-						},
-						{
-							value:  float64(s.Tcp6.SynSent),
-							labels: []string{"synsent"},
-						},
-						{
-							value:  float64(s.Tcp6.SynRecv),
-							labels: []string{"synrecv"},
-						},
-						{
-							value:  float64(s.Tcp6.FinWait1),
-							labels: []string{"finwait1"},
-						},
-						{
-							value:  float64(s.Tcp6.FinWait2),
-							labels: []string{"finwait2"},
-						},
-						{
-							value:  float64(s.Tcp6.TimeWait),
-							labels: []string{"timewait"},
-						},
-						{
-							value:  float64(s.Tcp6.Close),
-							labels: []string{"close"},
-						},
-						{
-							value:  float64(s.Tcp6.CloseWait),
-							labels: []string{"closewait"},
-						},
-						{
-							value:  float64(s.Tcp6.LastAck),
-							labels: []string{"lastack"},
-						},
-						{
-							value:  float64(s.Tcp6.Listen),
-							labels: []string{"listen"},
-						},
-						{
-							value:  float64(s.Tcp6.Closing),
-							labels: []string{"closing"},
-						},
+		},
+		{
+			name:        "yq_container_tcp_peer_connections",
+			help:        "tcp connections with the remote ips having most connections for container by yanqing-exporter, limited to peer_metrics_top_n ips",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"peer_ip", "tcp_state"},
+			getValues: func(s *docker.ContainerStats) metricValues {
+				values := metricValues{}
+				for i, peer := range s.Peers.Ips {
+					if i >= *peerMetricsTopN {
+						break
 					}
-				},
-			}, {
-				name:        "yq_container_network_udp6_usage_total",
-				help:        "udp6 connection usage statistic for container by yanqing-exporter",
-				valueType:   prometheus.GaugeValue,
-				extraLabels: []string{"udp6_state"},
-				getValues: func(s *docker.ContainerStats) metricValues {
-					return metricValues{
-						{
-							value:  float64(s.Udp6.Listen),
-							labels: []string{"listen"},
-						},
-						{
-							value:  float64(s.Udp6.Dropped),
-							labels: []string{"dropped"},
-						},
-						{
-							value:  float64(s.Udp6.RxQueued),
-							labels: []string{"rxqueued"},
-						},
-						{
-							value:  float64(s.Udp6.TxQueued),
-							labels: []string{"txqueued"},
-						},
+					for state, count := range peer.States {
+						values = append(values, metricValue{
+							value:  float64(count),
+							labels: []string{peer.Ip, state},
+						})
 					}
-				},
-			}, {
-				name:        "yq_container_network_tcpext_usage_total",
-				help:        "tcpext usage statistic for container by yanqing-exporter",
-				valueType:   prometheus.GaugeValue,
-				extraLabels: []string{"tcpext_state"},
-				getValues: func(s *docker.ContainerStats) metricValues {
-					return metricValues{
-						{
-							value:  float64(s.TcpExt.PruneCalled),
-							labels: []string{"pruneCalled"},
-						},
-						{
-							value:  float64(s.TcpExt.LockDroppedIcmps),
-							labels: []string{"lockdroppedicmps"},
-						},
-						{
-							value:  float64(s.TcpExt.ArpFilter),
-							labels: []string{"arpfilter"},
-						},
-						{
-							value:  float64(s.TcpExt.TW),
-							labels: []string{"tw"},
-						},
-						{
-							value:  float64(s.TcpExt.DelayedACKLocked),
-							labels: []string{"delayedacklocked"},
-						},
-						{
-							value:  float64(s.TcpExt.ListenOverflows),
-							labels: []string{"listenoverflows"},
-						},
-						{
-							value:  float64(s.TcpExt.ListenDrops),
-							labels: []string{"listendrops"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPPrequeueDropped),
-							labels: []string{"tcpprequeuedropped"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPTSReorder),
-							labels: []string{"tcptsreorder"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPDSACKUndo),
-							labels: []string{"tcpdsackundo"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPLostRetransmit),
-							labels: []string{"tcplostretransmit"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPLossFailures),
-							labels: []string{"tcplossfailures"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPFastRetrans),
-							labels: []string{"tcpfastretrans"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPTimeouts),
-							labels: []string{"tcptimeouts"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPSchedulerFailed),
-							labels: []string{"tcpschedulerfailed"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPAbortOnMemory),
-							labels: []string{"tcpabortonmemory"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPAbortOnTimeout),
-							labels: []string{"tcpabortontimeout"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPAbortFailed),
-							labels: []string{"tcpabortfailed"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPMemoryPressures),
-							labels: []string{"tcpmemorypressures"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPSpuriousRTOs),
-							labels: []string{"tcpspuriousrtos"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPBacklogDrop),
-							labels: []string{"tcpbacklogdrop"},
-						},
-						{
-							value:  float64(s.TcpExt.TCPMinTTLDrop),
-							labels: []string{"tcpminttldrop"},
-						},
+				}
+				return values
+			},
+		},
+		{
+			name:        "yq_container_tcp_connections_opened_total",
+			help:        "tcp connections opened by container by yanqing-exporter, inbound ones being accepted on a listening port",
+			valueType:   prometheus.CounterValue,
+			extraLabels: []string{"direction"},
+			getValues: func(s *docker.ContainerStats) metricValues {
+				if s.Churn == nil {
+					return nil
+				}
+				return metricValues{
+					{
+						value:  float64(s.Churn.Total.InboundOpened),
+						labels: []string{"inbound"},
+					},
+					{
+						value:  float64(s.Churn.Total.OutboundOpened),
+						labels: []string{"outbound"},
+					},
+				}
+			},
+		},
+		{
+			name:        "yq_container_tcp_connections_closed_total",
+			help:        "tcp connections closed by container by yanqing-exporter, inbound ones being accepted on a listening port",
+			valueType:   prometheus.CounterValue,
+			extraLabels: []string{"direction"},
+			getValues: func(s *docker.ContainerStats) metricValues {
+				if s.Churn == nil {
+					return nil
+				}
+				return metricValues{
+					{
+						value:  float64(s.Churn.Total.InboundClosed),
+						labels: []string{"inbound"},
+					},
+					{
+						value:  float64(s.Churn.Total.OutboundClosed),
+						labels: []string{"outbound"},
+					},
+				}
+			},
+		},
+		{
+			name:        "yq_container_tcp_connection_age_seconds",
+			help:        "age of established and close_wait tcp connections for container by yanqing-exporter, counted from when they were first seen",
+			extraLabels: []string{"tcp_state"},
+			getHistograms: func(s *docker.ContainerStats) metricHistograms {
+				histograms := metricHistograms{}
+				for _, age := range s.ConnectionAges {
+					buckets := make(map[float64]uint64, len(age.Buckets))
+					for _, bucket := range age.Buckets {
+						buckets[bucket.UpperBound] = bucket.Count
 					}
-				},
+					histograms = append(histograms, metricHistogram{
+						count:   age.Count,
+						sum:     age.Sum,
+						buckets: buckets,
+						labels:  []string{age.State},
+					})
+				}
+				return histograms
+			},
+		},
+		{
+			name:        "yq_container_tcp_connection_age_max_seconds",
+			help:        "age of the oldest established and close_wait tcp connections for container by yanqing-exporter, counted from when they were first seen",
+			valueType:   prometheus.GaugeValue,
+			extraLabels: []string{"tcp_state"},
+			getValues: func(s *docker.ContainerStats) metricValues {
+				values := metricValues{}
+				for _, age := range s.ConnectionAges {
+					values = append(values, metricValue{
+						value:  age.Max,
+						labels: []string{age.State},
+					})
+				}
+				return values
+			},
+		},
+		{
+			name:        "yq_container_tcp_timer_sockets",
+			help:        "tcp sockets by pending timer for container by yanqing-exporter, retransmit and zero_window_probe pointing at unreachable or stalled peers",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"timer"},
+			getValues: func(s *docker.ContainerStats) metricValues {
+				return metricValues{
+					{
+						value:  float64(s.TcpTimers.Retransmit),
+						labels: []string{"retransmit"},
+					},
+					{
+						value:  float64(s.TcpTimers.ZeroWindowProbe),
+						labels: []string{"zero_window_probe"},
+					},
+					{
+						value:  float64(s.TcpTimers.Keepalive),
+						labels: []string{"keepalive"},
+					},
+				}
+			},
+		},
+		{
+			name:      "yq_container_tcp_retransmits_max",
+			help:      "highest number of unrecovered retransmission timeouts of a tcp socket for container by yanqing-exporter",
+			valueType: prometheus.GaugeValue,
+			windowed:  true,
+			getValues: func(s *docker.ContainerStats) metricValues {
+				return metricValues{{value: float64(s.TcpTimers.MaxRetransmits)}}
+			},
+		},
+		{
+			name:        "yq_container_fds",
+			help:        "open file descriptors of container by yanqing-exporter",
+			valueType:   prometheus.GaugeValue,
+			windowed:    true,
+			extraLabels: []string{"fd_type"},
+			getValues: func(s *docker.ContainerStats) metricValues {
+				if s.Fds == nil {
+					return nil
+				}
+				return metricValues{
+					{
+						value:  float64(s.Fds.Sockets),
+						labels: []string{"socket"},
+					},
+					{
+						value:  float64(s.Fds.Pipes),
+						labels: []string{"pipe"},
+					},
+					{
+						value:  float64(s.Fds.AnonInodes),
+						labels: []string{"anon_inode"},
+					},
+					{
+						value:  float64(s.Fds.Files),
+						labels: []string{"file"},
+					},
+				}
+			},
+		},
+		{
+			name:      "yq_container_fd_limit",
+			help:      "open files soft limit of the process of container closest to it by yanqing-exporter",
+			valueType: prometheus.GaugeValue,
+			getValues: func(s *docker.ContainerStats) metricValues {
+				// no process with a limit
+				if s.Fds == nil || s.Fds.MaxLimit == 0 {
+					return nil
+				}
+				return metricValues{{value: float64(s.Fds.MaxLimit)}}
+			},
+		},
+		{
+			name:      "yq_container_fd_utilization_max",
+			help:      "highest ratio of open file descriptors to the open files soft limit of a process of container by yanqing-exporter",
+			valueType: prometheus.GaugeValue,
+			windowed:  true,
+			getValues: func(s *docker.ContainerStats) metricValues {
+				if s.Fds == nil || s.Fds.MaxLimit == 0 {
+					return nil
+				}
+				return metricValues{{value: s.Fds.MaxUtilization}}
+			},
+		},
+		{
+			name:        "yq_container_network_sysctl",
+			help:        "network sysctl of container by yanqing-exporter, refreshed every sysctl_interval",
+			valueType:   prometheus.GaugeValue,
+			extraLabels: []string{"sysctl"},
+			netnsWide:   true,
+			getValues: func(s *docker.ContainerStats) metricValues {
+				// not read yet
+				if s.Sysctl == (types.SysctlStat{}) {
+					return nil
+				}
+				return metricValues{
+					{
+						value:  float64(s.Sysctl.Somaxconn),
+						labels: []string{"net.core.somaxconn"},
+					},
+					{
+						value:  float64(s.Sysctl.TcpMaxSynBacklog),
+						labels: []string{"net.ipv4.tcp_max_syn_backlog"},
+					},
+					{
+						value:  float64(s.Sysctl.TcpTwReuse),
+						labels: []string{"net.ipv4.tcp_tw_reuse"},
+					},
+					{
+						value:  float64(s.Sysctl.TcpFinTimeout),
+						labels: []string{"net.ipv4.tcp_fin_timeout"},
+					},
+					{
+						value:  float64(s.Sysctl.TcpKeepaliveTime),
+						labels: []string{"net.ipv4.tcp_keepalive_time"},
+					},
+					{
+						value:  float64(s.Sysctl.IpLocalPortRangeMin),
+						labels: []string{"net.ipv4.ip_local_port_range.min"},
+					},
+					{
+						value:  float64(s.Sysctl.IpLocalPortRangeMax),
+						labels: []string{"net.ipv4.ip_local_port_range.max"},
+					},
+					{
+						value:  float64(s.Sysctl.RmemDefault),
+						labels: []string{"net.core.rmem_default"},
+					},
+					{
+						value:  float64(s.Sysctl.RmemMax),
+						labels: []string{"net.core.rmem_max"},
+					},
+				}
 			},
 		},
-		cacheStorage: memoryStorage,
 	}
 }
 
 func (y *yanqingCollector) Describe(ch chan<- *prometheus.Desc) {
 	for _, cm := range y.containerMetrics {
 		ch <- cm.desc([]string{})
+		if desc := cm.hostDesc(); desc != nil {
+			ch <- desc
+		}
+		if !cm.windowed {
+			continue
+		}
+		for _, aggregation := range []string{"min", "max", "avg"} {
+			wm := cm.windowMetric(aggregation)
+			ch <- wm.desc([]string{})
+			if desc := wm.hostDesc(); desc != nil {
+				ch <- desc
+			}
+		}
 	}
 	ch <- yanqingScropedLastSeenDesc
+	ch <- yqContainerConnectionsDesc
+	ch <- yqClusterConnectionsDesc
+	ch <- yqIpvsConnectionsDesc
+	ch <- yqIpvsPacketsDesc
+	ch <- yqIpvsBytesDesc
+	ch <- yqIpvsServiceStateDesc
+	ch <- yqIpvsBackendDesc
+	ch <- yqIpvsBackendWeightDesc
+	ch <- yqInterfaceDropsDesc
+	ch <- yqInterfaceErrorsDesc
+	ch <- yqInterfacePacketsDesc
+	ch <- yqSoftnetProcessedDesc
+	ch <- yqSoftnetDroppedDesc
+	ch <- yqSoftnetTimeSqueezeDesc
+	ch <- yqStorageBytesDesc
+	ch <- yqStorageBudgetDesc
+	ch <- yqStorageSamplesDesc
+	ch <- yqStorageEvictedDesc
 }
 
 func (y *yanqingCollector) Collect(ch chan<- prometheus.Metric) {
 	y.collectLastSeen(ch)
 	y.collectContainerStats(ch)
+	y.collectHostStats(ch)
+	y.collectConnections(ch)
+	y.collectIpvs(ch)
+	y.collectHostInterfaces(ch)
+	y.collectStorage(ch)
+}
+
+// collectStorage sends the memory usage of the storage.
+func (y *yanqingCollector) collectStorage(ch chan<- prometheus.Metric) {
+	usage := y.cacheStorage.GetUsage()
+	ch <- prometheus.MustNewConstMetric(yqStorageBytesDesc, prometheus.GaugeValue, float64(usage.Bytes))
+	ch <- prometheus.MustNewConstMetric(yqStorageBudgetDesc, prometheus.GaugeValue, float64(usage.Budget))
+	ch <- prometheus.MustNewConstMetric(yqStorageSamplesDesc, prometheus.GaugeValue, float64(usage.Samples))
+	ch <- prometheus.MustNewConstMetric(yqStorageEvictedDesc, prometheus.CounterValue, float64(usage.EvictedSamples))
 }
 
 func DefaultLabels(container *docker.ContainerInfo) map[string]string {
@@ -384,7 +1131,7 @@ func (*yanqingCollector) collectLastSeen(ch chan<- prometheus.Metric) {
 
 func (y *yanqingCollector) collectContainerStats(ch chan<- prometheus.Metric) {
 	containerInfos := y.cacheStorage.GetAllContainerInfo()
-	for _, container := range containerInfos {
+	for name, container := range containerInfos {
 		labels, values := []string{}, []string{}
 		for l, v := range y.containerLabelsFunc(container) {
 			labels = append(labels, sanitizeLabelName(l))
@@ -393,16 +1140,175 @@ func (y *yanqingCollector) collectContainerStats(ch chan<- prometheus.Metric) {
 		l := len(container.Stats)
 		if l > 0 {
 			stats := container.Stats[l-1]
+			y.collectNetworkInfo(ch, container, stats, labels, values)
 			for _, cm := range y.containerMetrics {
-				desc := cm.desc(labels)
-				for _, metricValue := range cm.getValues(stats) {
-					ch <- prometheus.MustNewConstMetric(desc, cm.valueType, float64(metricValue.value), append(values, metricValue.labels...)...)
+				// namespaces not owned by the container are reported by their owner
+				if cm.netnsWide && stats.SharedNetwork() {
+					continue
 				}
+				cm.collect(ch, cm.desc(labels), stats, values)
+			}
+			y.collectContainerWindow(ch, name, stats, labels, values)
+		}
+	}
+}
+
+// collectContainerWindow sends the aggregations of the windowed metrics of a
+// container from the aggregates of the storage.
+func (y *yanqingCollector) collectContainerWindow(ch chan<- prometheus.Metric, name string, stats *docker.ContainerStats, labels, values []string) {
+	aggregates, err := y.cacheStorage.GetWindowAggregates(name)
+	if err != nil || len(aggregates) == 0 {
+		return
+	}
+	window := aggregatesByMetric(aggregates)
+	desc := func(wm *containerMetric) *prometheus.Desc {
+		return wm.desc(labels)
+	}
+	for _, cm := range y.containerMetrics {
+		if !cm.windowed || cm.netnsWide && stats.SharedNetwork() {
+			continue
+		}
+		cm.collectWindow(ch, desc, window[cm.name], values)
+	}
+}
+
+// collectNetworkInfo exports the network namespace of a container, and which
+// container owns it when it is joined with --net=container:<id>.
+func (*yanqingCollector) collectNetworkInfo(ch chan<- prometheus.Metric, container *docker.ContainerInfo, stats *docker.ContainerStats, labels, values []string) {
+	desc := prometheus.NewDesc(
+		"yq_container_network_info",
+		"network namespace of container by yanqing-exporter, only the own sockets of containers with host or container network_mode are reported",
+		append(labels, "network_mode", "network_container", "netns"), nil)
+	netns := strconv.FormatUint(stats.Netns, 10)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, append(values, stats.NetworkMode, container.Spec.NetworkContainer, netns)...)
+}
+
+func (y *yanqingCollector) collectHostStats(ch chan<- prometheus.Metric) {
+	windows := y.cacheStorage.GetHostWindowAggregates()
+	for target, stats := range y.cacheStorage.GetHostStats() {
+		window := aggregatesByMetric(windows[target])
+		for _, cm := range y.containerMetrics {
+			desc := cm.hostDesc()
+			if desc == nil {
+				continue
+			}
+			// only sockets can be attributed to host network containers
+			if cm.netnsWide && target != storage.HostTarget {
+				continue
 			}
+			cm.collect(ch, desc, stats, []string{target})
+			if cm.windowed {
+				cm.collectWindow(ch, (*containerMetric).hostDesc, window[cm.name], []string{target})
+			}
+		}
+	}
+}
+
+// collectConnections exports the node-local connection graph, containers
+// being named after their first alias, and the connections with the rest of
+// the cluster.
+func (y *yanqingCollector) collectConnections(ch chan<- prometheus.Metric) {
+	containerInfos := y.cacheStorage.GetAllContainerInfo()
+	for _, container := range containerInfos {
+		l := len(container.Stats)
+		if l == 0 {
+			continue
+		}
+		src := containerAlias(container)
+		for _, connections := range container.Stats[l-1].Connections {
+			dst := connections.Container
+			if dstContainer, ok := containerInfos[dst]; ok {
+				dst = containerAlias(dstContainer)
+			}
+			for state, count := range connections.States {
+				ch <- prometheus.MustNewConstMetric(yqContainerConnectionsDesc, prometheus.GaugeValue, float64(count), src, dst, state)
+			}
+		}
+		for _, connections := range container.Stats[l-1].ClusterConnections {
+			dst := connections.Workload
+			for state, count := range connections.States {
+				ch <- prometheus.MustNewConstMetric(yqClusterConnectionsDesc, prometheus.GaugeValue, float64(count), src, dst.Kind, dst.Namespace, dst.Name, state)
+			}
+		}
+	}
+}
+
+// collectIpvs exports the ipvs virtual services of the host, labelling real
+// servers with the container, and its pod, owning their ip.
+func (y *yanqingCollector) collectIpvs(ch chan<- prometheus.Metric) {
+	hostStats, ok := y.cacheStorage.GetHostStats()[storage.HostTarget]
+	if !ok || hostStats.Ipvs == nil {
+		return
+	}
+	ipvs := hostStats.Ipvs
+	containerInfos := y.cacheStorage.GetAllContainerInfo()
+
+	ch <- prometheus.MustNewConstMetric(yqIpvsConnectionsDesc, prometheus.CounterValue, float64(ipvs.Connections))
+	ch <- prometheus.MustNewConstMetric(yqIpvsPacketsDesc, prometheus.CounterValue, float64(ipvs.IncomingPackets), "incoming")
+	ch <- prometheus.MustNewConstMetric(yqIpvsPacketsDesc, prometheus.CounterValue, float64(ipvs.OutgoingPackets), "outgoing")
+	ch <- prometheus.MustNewConstMetric(yqIpvsBytesDesc, prometheus.CounterValue, float64(ipvs.IncomingBytes), "incoming")
+	ch <- prometheus.MustNewConstMetric(yqIpvsBytesDesc, prometheus.CounterValue, float64(ipvs.OutgoingBytes), "outgoing")
+
+	for _, service := range ipvs.Services {
+		virtualPort := strconv.Itoa(int(service.Port))
+		for state, count := range service.States {
+			ch <- prometheus.MustNewConstMetric(yqIpvsServiceStateDesc, prometheus.GaugeValue, float64(count), service.Protocol, service.Address, virtualPort, state)
+		}
+		for _, backend := range service.Backends {
+			values := append([]string{service.Protocol, service.Address, virtualPort, backend.Address, strconv.Itoa(int(backend.Port))}, containerIdentity(containerInfos, backend.Container)...)
+			ch <- prometheus.MustNewConstMetric(yqIpvsBackendDesc, prometheus.GaugeValue, float64(backend.ActiveConn), append(values, "active")...)
+			ch <- prometheus.MustNewConstMetric(yqIpvsBackendDesc, prometheus.GaugeValue, float64(backend.InactiveConn), append(values, "inactive")...)
+			ch <- prometheus.MustNewConstMetric(yqIpvsBackendWeightDesc, prometheus.GaugeValue, float64(backend.Weight), values...)
 		}
 	}
 }
 
+// collectHostInterfaces exports the softnet backlog of each cpu and the
+// counters of host interfaces, labelling veths with their container.
+func (y *yanqingCollector) collectHostInterfaces(ch chan<- prometheus.Metric) {
+	hostStats, ok := y.cacheStorage.GetHostStats()[storage.HostTarget]
+	if !ok {
+		return
+	}
+
+	for _, softnet := range hostStats.Softnet {
+		cpu := strconv.Itoa(softnet.Cpu)
+		ch <- prometheus.MustNewConstMetric(yqSoftnetProcessedDesc, prometheus.CounterValue, float64(softnet.Processed), cpu)
+		ch <- prometheus.MustNewConstMetric(yqSoftnetDroppedDesc, prometheus.CounterValue, float64(softnet.Dropped), cpu)
+		ch <- prometheus.MustNewConstMetric(yqSoftnetTimeSqueezeDesc, prometheus.CounterValue, float64(softnet.TimeSqueeze), cpu)
+	}
+
+	containerInfos := y.cacheStorage.GetAllContainerInfo()
+	for _, iface := range hostStats.Interfaces {
+		identity := containerIdentity(containerInfos, iface.Container)
+		rx := append([]string{iface.Name, "rx"}, identity...)
+		tx := append([]string{iface.Name, "tx"}, identity...)
+		ch <- prometheus.MustNewConstMetric(yqInterfaceDropsDesc, prometheus.CounterValue, float64(iface.RxDropped), rx...)
+		ch <- prometheus.MustNewConstMetric(yqInterfaceDropsDesc, prometheus.CounterValue, float64(iface.TxDropped), tx...)
+		ch <- prometheus.MustNewConstMetric(yqInterfaceErrorsDesc, prometheus.CounterValue, float64(iface.RxErrors), rx...)
+		ch <- prometheus.MustNewConstMetric(yqInterfaceErrorsDesc, prometheus.CounterValue, float64(iface.TxErrors), tx...)
+		ch <- prometheus.MustNewConstMetric(yqInterfacePacketsDesc, prometheus.CounterValue, float64(iface.RxPackets), rx...)
+		ch <- prometheus.MustNewConstMetric(yqInterfacePacketsDesc, prometheus.CounterValue, float64(iface.TxPackets), tx...)
+	}
+}
+
+// containerIdentity returns the alias, pod and namespace of a container, all
+// empty when it is unknown.
+func containerIdentity(containerInfos map[string]*docker.ContainerInfo, name string) []string {
+	container, ok := containerInfos[name]
+	if !ok {
+		return []string{"", "", ""}
+	}
+	return []string{containerAlias(container), container.Labels[ContainerLabelPodName], container.Labels[ContainerLabelPodNamespace]}
+}
+
+func containerAlias(container *docker.ContainerInfo) string {
+	if len(container.Aliases) > 0 {
+		return container.Aliases[0]
+	}
+	return container.Name
+}
+
 var invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 
 func sanitizeLabelName(name string) string {
@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	info "github.com/google/cadvisor/info/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/yanqing-exporter/collector/types"
+	"github.com/yanqing-exporter/container/docker"
+	"github.com/yanqing-exporter/storage"
+)
+
+func newTestStats(i int) *docker.ContainerStats {
+	stats := &docker.ContainerStats{
+		Timestamp: time.Now(),
+		Peers: types.PeerStat{Ips: []types.PeerConnections{
+			{Ip: "10.244.1.3", Total: uint64(i), States: map[string]uint64{"established": uint64(i)}},
+		}},
+		Connections: []types.ContainerConnections{
+			{Container: "/docker/test-1", States: map[string]uint64{"established": 1}},
+		},
+		ConnectionAges: []types.ConnectionAgeStat{
+			{State: "established", Count: 1, Buckets: []types.AgeBucket{{UpperBound: 60, Count: 1}}},
+		},
+		Fds: &types.FdStat{Processes: 1, Sockets: uint64(i), MaxLimit: 1024},
+	}
+	stats.Tcp.Established = uint64(i)
+	stats.TcpWithPort = types.TcpStatWithPort{Stats: map[int64]info.TcpStat{80: {Established: uint64(i)}}}
+	return stats
+}
+
+// TestConcurrentScrape runs collections, housekeeping, scrapes and api reads
+// of the storage at the same time, to be run with -race.
+func TestConcurrentScrape(t *testing.T) {
+	s := storage.New(5, 0, 0, nil)
+	collector := NewCollector(s)
+	names := make([]string, 10)
+	for i := range names {
+		names[i] = fmt.Sprintf("/docker/test-%d", i)
+	}
+
+	// every goroutine runs until the deadline so that they overlap
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(500 * time.Millisecond)
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; time.Now().Before(deadline); i++ {
+				f(i)
+			}
+		}()
+	}
+
+	// collection
+	run(func(i int) {
+		for _, name := range names {
+			s.UpdateContainerInfo(name, &docker.ContainerInfo{
+				ContainerReference: info.ContainerReference{Name: name, Labels: map[string]string{ContainerLabelPodName: "test"}},
+				Spec:               docker.ContainerSpec{Pid: 100 + i},
+			})
+			s.AddStats(name, newTestStats(i))
+		}
+		s.UpdateHostStats(storage.HostTarget, newTestStats(i))
+	})
+	// housekeeping
+	run(func(i int) {
+		for name, container := range s.GetAllContainerInfo() {
+			if l := len(container.Stats); l > 0 && container.Stats[l-1].Tcp.Established%7 == 6 {
+				s.RemoveContainerInfo(name)
+			}
+		}
+	})
+	// scrapes
+	run(func(i int) {
+		ch := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			for range ch {
+			}
+			close(done)
+		}()
+		collector.Collect(ch)
+		close(ch)
+		<-done
+	})
+	// api
+	run(func(i int) {
+		if _, err := json.Marshal(s.GetAllContainerInfo()); err != nil {
+			t.Error(err)
+		}
+		if _, err := json.Marshal(s.GetHostStats()); err != nil {
+			t.Error(err)
+		}
+		for _, name := range names {
+			s.GetStatsRange(name, time.Now().Add(-time.Minute), time.Time{}, 3)
+		}
+	})
+	wg.Wait()
+}
+
+func TestSnapshotIsReadOnly(t *testing.T) {
+	s := storage.New(5, 0, 0, nil)
+	s.UpdateContainerInfo("/docker/test", &docker.ContainerInfo{ContainerReference: info.ContainerReference{Name: "/docker/test"}})
+	first := newTestStats(1)
+	s.AddStats("/docker/test", first)
+
+	snapshot := s.GetAllContainerInfo()
+	container := snapshot["/docker/test"]
+	if again := s.GetAllContainerInfo(); again["/docker/test"] != container {
+		t.Errorf("expected the snapshot to be shared until the storage changes")
+	}
+
+	s.AddStats("/docker/test", newTestStats(2))
+	s.UpdateContainerInfo("/docker/other", &docker.ContainerInfo{ContainerReference: info.ContainerReference{Name: "/docker/other"}})
+	if len(snapshot) != 1 || len(container.Stats) != 1 || container.Stats[0] != first {
+		t.Errorf("expected the snapshot to be left unchanged by updates")
+	}
+	if latest := s.GetAllContainerInfo()["/docker/test"]; latest == container || latest.Stats[0].Tcp.Established != 2 {
+		t.Errorf("expected a new snapshot with the latest stats")
+	}
+}
+
+func TestWindowMetrics(t *testing.T) {
+	s := storage.New(5, 0, time.Minute, WindowValues)
+	s.UpdateContainerInfo("/docker/test", &docker.ContainerInfo{ContainerReference: info.ContainerReference{Name: "/docker/test"}})
+	start := time.Now()
+	// a burst between two scrapes
+	for i, established := range []int{3, 40, 5} {
+		stats := newTestStats(established)
+		stats.Timestamp = start.Add(time.Duration(i) * 10 * time.Second)
+		s.AddStats("/docker/test", stats)
+	}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		NewCollector(s).Collect(ch)
+		close(ch)
+	}()
+	values := map[string]float64{}
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		desc := m.Desc().String()
+		if !strings.Contains(desc, `"yq_container_network_tcp_usage_total`) {
+			continue
+		}
+		for _, label := range metric.Label {
+			if label.GetName() == "tcp_state" && label.GetValue() == "established" {
+				values[desc[strings.Index(desc, `"`)+1:strings.Index(desc, `",`)]] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+
+	expected := map[string]float64{
+		"yq_container_network_tcp_usage_total":                 5,
+		"yq_container_network_tcp_usage_total_min_over_window": 3,
+		"yq_container_network_tcp_usage_total_max_over_window": 40,
+		"yq_container_network_tcp_usage_total_avg_over_window": 16,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+}
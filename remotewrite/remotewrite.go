@@ -0,0 +1,333 @@
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Config of the remote write endpoint. Password and bearer token files are
+// read on every request, so that they can be rotated.
+type Config struct {
+	URL             string
+	Username        string
+	PasswordFile    string
+	BearerTokenFile string
+	Timeout         time.Duration
+	// BatchSize is the number of series sent per request.
+	BatchSize int
+	// QueueCapacity bounds the series waiting to be sent, the oldest ones
+	// being dropped beyond it while the endpoint is unreachable.
+	QueueCapacity int
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	// ExternalLabels are added to every series unless set by its metric,
+	// such as the instance the series come from as a scrape would.
+	ExternalLabels map[string]string
+}
+
+var labelNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// ParseExternalLabels parses comma separated name=value labels.
+func ParseExternalLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		name := strings.TrimSpace(pair[:i])
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		labels[name] = strings.TrimSpace(pair[i+1:])
+	}
+	return labels, nil
+}
+
+// Writer pushes the series gathered after every collection to a Prometheus
+// remote write endpoint, as snappy compressed protobuf. Requests failing
+// with a network error or a 5xx or 429 status are retried with an exponential
+// backoff, other failures dropping the batch.
+type Writer struct {
+	gatherer prometheus.Gatherer
+	config   Config
+	client   *http.Client
+
+	lock    sync.Mutex
+	queue   []*TimeSeries
+	dropped uint64
+	// notify wakes the sender up when series are queued.
+	notify chan struct{}
+	quit   chan error
+}
+
+func NewWriter(gatherer prometheus.Gatherer, config Config) (*Writer, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no remote write url")
+	}
+	if config.BatchSize <= 0 || config.QueueCapacity <= 0 {
+		return nil, fmt.Errorf("invalid remote write batch size %d or queue capacity %d", config.BatchSize, config.QueueCapacity)
+	}
+	if config.MinBackoff <= 0 || config.MaxBackoff < config.MinBackoff {
+		return nil, fmt.Errorf("invalid remote write backoff from %v to %v", config.MinBackoff, config.MaxBackoff)
+	}
+	return &Writer{
+		gatherer: gatherer,
+		config:   config,
+		client:   &http.Client{Timeout: config.Timeout},
+		notify:   make(chan struct{}, 1),
+	}, nil
+}
+
+func (w *Writer) Start() error {
+	w.quit = make(chan error)
+	go w.run()
+	return nil
+}
+
+// Stop stops sending, the series still queued being lost.
+func (w *Writer) Stop() error {
+	w.quit <- nil
+	return <-w.quit
+}
+
+// Collected queues the series gathered at the end of a collection.
+func (w *Writer) Collected() {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		// the consistent families are still gathered
+		glog.V(2).Infof("Unable to gather some metrics to write: %v", err)
+	}
+	w.enqueue(timeSeries(families, w.config.ExternalLabels, time.Now()))
+}
+
+func (w *Writer) enqueue(series []*TimeSeries) {
+	w.lock.Lock()
+	w.queue = append(w.queue, series...)
+	if n := len(w.queue) - w.config.QueueCapacity; n > 0 {
+		w.queue = append([]*TimeSeries(nil), w.queue[n:]...)
+		w.dropped += uint64(n)
+		glog.Warningf("Remote write queue is full, dropped %d series, %d in total", n, w.dropped)
+	}
+	w.lock.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Writer) dequeue() []*TimeSeries {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n := w.config.BatchSize
+	if n > len(w.queue) {
+		n = len(w.queue)
+	}
+	batch := w.queue[:n:n]
+	w.queue = w.queue[n:]
+	return batch
+}
+
+func (w *Writer) run() {
+	for {
+		select {
+		case <-w.quit:
+			w.quit <- nil
+			return
+		case <-w.notify:
+			for batch := w.dequeue(); len(batch) > 0; batch = w.dequeue() {
+				if !w.sendWithRetries(batch) {
+					w.quit <- nil
+					return
+				}
+			}
+		}
+	}
+}
+
+// sendWithRetries sends a batch until it succeeds or fails for good, and
+// returns false when the writer is stopped in between.
+func (w *Writer) sendWithRetries(batch []*TimeSeries) bool {
+	data, err := proto.Marshal(&WriteRequest{Timeseries: batch})
+	if err != nil {
+		glog.Errorf("Failed to marshal %d series to write: %v", len(batch), err)
+		return true
+	}
+	data = snappy.Encode(nil, data)
+
+	backoff := w.config.MinBackoff
+	for {
+		recoverable, err := w.send(data)
+		if err == nil {
+			return true
+		}
+		if !recoverable {
+			glog.Errorf("Failed to write %d series, dropping them: %v", len(batch), err)
+			return true
+		}
+		glog.V(2).Infof("Failed to write %d series, retrying in %v: %v", len(batch), backoff, err)
+
+		select {
+		case <-w.quit:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > w.config.MaxBackoff {
+			backoff = w.config.MaxBackoff
+		}
+	}
+}
+
+// send posts a compressed write request, and returns whether a failure can be
+// retried.
+func (w *Writer) send(data []byte) (bool, error) {
+	req, err := http.NewRequest("POST", w.config.URL, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "yanqing-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if err = w.authorize(req); err != nil {
+		return false, err
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+func (w *Writer) authorize(req *http.Request) error {
+	if w.config.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(w.config.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read bearer token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	if w.config.Username != "" {
+		var password []byte
+		if w.config.PasswordFile != "" {
+			var err error
+			password, err = ioutil.ReadFile(w.config.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("couldn't read password: %v", err)
+			}
+		}
+		req.SetBasicAuth(w.config.Username, strings.TrimSpace(string(password)))
+	}
+	return nil
+}
+
+// timeSeries converts gathered metrics into series of a sample at now, unless
+// they have a timestamp, labelled with the external labels. Histograms and
+// summaries are split into their _bucket, _sum and _count or quantile series
+// as when scraped.
+func timeSeries(families []*dto.MetricFamily, external map[string]string, now time.Time) []*TimeSeries {
+	var series []*TimeSeries
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			timestamp := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...string) {
+				series = append(series, newTimeSeries(name, m.Label, extra, external, value, timestamp))
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().Quantile {
+					add(name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", m.GetSummary().GetSampleSum())
+				add(name+"_count", float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				for _, b := range m.GetHistogram().Bucket {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add(name+"_bucket", float64(m.GetHistogram().GetSampleCount()), "le", "+Inf")
+				add(name+"_sum", m.GetHistogram().GetSampleSum())
+				add(name+"_count", float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// newTimeSeries returns a series of a sample, extra being pairs of label names
+// and values. The external labels are added unless already set.
+func newTimeSeries(name string, pairs []*dto.LabelPair, extra []string, external map[string]string, value float64, timestamp int64) *TimeSeries {
+	labels := make([]*Label, 0, len(pairs)+len(extra)/2+len(external)+1)
+	labels = append(labels, &Label{Name: "__name__", Value: name})
+	for _, pair := range pairs {
+		labels = append(labels, &Label{Name: pair.GetName(), Value: pair.GetValue()})
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels = append(labels, &Label{Name: extra[i], Value: extra[i+1]})
+	}
+	for labelName, labelValue := range external {
+		set := false
+		for _, l := range labels {
+			if l.Name == labelName {
+				set = true
+				break
+			}
+		}
+		if !set {
+			labels = append(labels, &Label{Name: labelName, Value: labelValue})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return &TimeSeries{
+		Labels:  labels,
+		Samples: []*Sample{{Value: value, Timestamp: timestamp}},
+	}
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,239 @@
+package remotewrite
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// receiver is a remote write endpoint answering the statuses in order, then
+// 204.
+type receiver struct {
+	lock     sync.Mutex
+	statuses []int
+	requests int
+	series   []*TimeSeries
+	auth     []string
+	received chan struct{}
+}
+
+func newReceiver(statuses ...int) *receiver {
+	return &receiver{statuses: statuses, received: make(chan struct{}, 100)}
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.requests++
+	rc.auth = append(rc.auth, r.Header.Get("Authorization"))
+	if len(rc.statuses) > 0 {
+		status := rc.statuses[0]
+		rc.statuses = rc.statuses[1:]
+		w.WriteHeader(status)
+		rc.received <- struct{}{}
+		return
+	}
+
+	if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected encoding", http.StatusBadRequest)
+		return
+	}
+	compressed, _ := ioutil.ReadAll(r.Body)
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req WriteRequest
+	if err = proto.Unmarshal(data, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc.series = append(rc.series, req.Timeseries...)
+	w.WriteHeader(http.StatusNoContent)
+	rc.received <- struct{}{}
+}
+
+// wait waits for n requests to be answered.
+func (rc *receiver) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-rc.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for request %d", i+1)
+		}
+	}
+}
+
+func newTestRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	usage := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "yq_container_network_tcp_usage_total", Help: "test"}, []string{"tcp_state", "name"})
+	usage.WithLabelValues("established", "/docker/test").Set(3)
+	usage.WithLabelValues("closewait", "/docker/test").Set(1)
+	age := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "yq_container_tcp_connection_age_seconds", Help: "test", Buckets: []float64{60}})
+	age.Observe(30)
+	age.Observe(90)
+	r.MustRegister(usage, age)
+	return r
+}
+
+func newTestConfig(url string) Config {
+	return Config{
+		URL:           url,
+		Timeout:       time.Second,
+		BatchSize:     4,
+		QueueCapacity: 100,
+		MinBackoff:    time.Millisecond,
+		MaxBackoff:    10 * time.Millisecond,
+	}
+}
+
+func TestWriter(t *testing.T) {
+	passwordFile, err := ioutil.TempFile(os.Getenv("TEST_YQ_DIR"), "yq_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwordFile.Name())
+	passwordFile.WriteString("secret\n")
+	passwordFile.Close()
+
+	// the endpoint is down for the first attempt
+	rc := newReceiver(http.StatusServiceUnavailable)
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	config := newTestConfig(server.URL)
+	config.Username, config.PasswordFile = "yq", passwordFile.Name()
+	// labels set by the metrics are kept
+	config.ExternalLabels = map[string]string{"instance": "10.0.0.1", "name": "node"}
+	w, err := NewWriter(newTestRegistry(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	defer w.Stop()
+
+	w.Collected()
+	// a failure and 2 batches of the 6 series
+	rc.wait(t, 3)
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.requests != 3 || len(rc.series) != 6 {
+		t.Fatalf("expected 6 series in 2 batches after a retry, got %d series in %d requests", len(rc.series), rc.requests)
+	}
+	for _, auth := range rc.auth {
+		if auth != "Basic eXE6c2VjcmV0" {
+			t.Errorf("expected basic auth, got %q", auth)
+		}
+	}
+	values := map[string]float64{}
+	for _, s := range rc.series {
+		var labels []string
+		for i, l := range s.Labels {
+			if i > 0 && s.Labels[i-1].Name >= l.Name {
+				t.Errorf("expected labels sorted by name, got %v", s.Labels)
+			}
+			labels = append(labels, l.Name+"="+l.Value)
+		}
+		if len(s.Samples) != 1 || s.Samples[0].Timestamp == 0 {
+			t.Fatalf("expected a sample with a timestamp, got %v", s.Samples)
+		}
+		values[strings.Join(labels, ",")] = s.Samples[0].Value
+	}
+	expected := map[string]float64{
+		"__name__=yq_container_network_tcp_usage_total,instance=10.0.0.1,name=/docker/test,tcp_state=closewait":   1,
+		"__name__=yq_container_network_tcp_usage_total,instance=10.0.0.1,name=/docker/test,tcp_state=established": 3,
+		"__name__=yq_container_tcp_connection_age_seconds_bucket,instance=10.0.0.1,le=60,name=node":               1,
+		"__name__=yq_container_tcp_connection_age_seconds_bucket,instance=10.0.0.1,le=+Inf,name=node":             2,
+		"__name__=yq_container_tcp_connection_age_seconds_sum,instance=10.0.0.1,name=node":                        120,
+		"__name__=yq_container_tcp_connection_age_seconds_count,instance=10.0.0.1,name=node":                      2,
+	}
+	for series, value := range expected {
+		if v, ok := values[series]; !ok || v != value {
+			t.Errorf("expected %s %v, got %v", series, value, values)
+		}
+	}
+}
+
+func TestWriterDropsRejectedBatches(t *testing.T) {
+	tokenFile, err := ioutil.TempFile(os.Getenv("TEST_YQ_DIR"), "yq_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("token")
+	tokenFile.Close()
+
+	rc := newReceiver(http.StatusBadRequest)
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	config := newTestConfig(server.URL)
+	config.BearerTokenFile = tokenFile.Name()
+	w, err := NewWriter(newTestRegistry(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	defer w.Stop()
+
+	w.Collected()
+	rc.wait(t, 2)
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	// the first batch is not retried
+	if rc.requests != 2 || len(rc.series) != 2 {
+		t.Errorf("expected the rejected batch to be dropped, got %d series in %d requests", len(rc.series), rc.requests)
+	}
+	if rc.auth[0] != "Bearer token" {
+		t.Errorf("expected bearer auth, got %q", rc.auth[0])
+	}
+}
+
+func TestWriterQueueCapacity(t *testing.T) {
+	config := newTestConfig("http://127.0.0.1:0")
+	config.QueueCapacity = 5
+	w, err := NewWriter(newTestRegistry(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the endpoint is unreachable
+	w.Collected()
+	w.Collected()
+	if len(w.queue) != 5 || w.dropped != 7 {
+		t.Fatalf("expected the oldest series to be dropped, got %d queued and %d dropped", len(w.queue), w.dropped)
+	}
+	if name := w.queue[len(w.queue)-1].Labels[0].Value; name != "yq_container_tcp_connection_age_seconds_count" {
+		t.Errorf("expected the latest series to be kept, got %s", name)
+	}
+
+	if _, err = NewWriter(newTestRegistry(), Config{URL: config.URL}); err == nil {
+		t.Errorf("expected an error for an invalid config")
+	}
+}
+
+func TestParseExternalLabels(t *testing.T) {
+	labels, err := ParseExternalLabels("instance=node-1, region = edge-2,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"instance": "node-1", "region": "edge-2"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+	for _, invalid := range []string{"instance", "1abc=x", "__name__=x", "a-b=x"} {
+		if _, err = ParseExternalLabels(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
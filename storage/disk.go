@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/yanqing-exporter/container/docker"
+)
+
+const (
+	segmentSuffix = ".jsonl"
+	// segmentsPerRetention is the number of segments the retention limits
+	// are split into, so that expiring the oldest one drops a fraction of
+	// the history only.
+	segmentsPerRetention = 8
+	// maxRecordSize bounds a line of a segment, a host stats record with
+	// many peers and connections being far larger than the default 64KB.
+	maxRecordSize = 16 * 1024 * 1024
+)
+
+// restoreGracePeriod is the time given to the watcher to update the containers
+// whose history was restored, the histories of the other ones being dropped.
+var restoreGracePeriod = 10 * time.Minute
+
+// Operations recorded in segments.
+const (
+	opChunk  = "chunk"
+	opRemove = "remove"
+	opHost   = "host"
+)
+
+type diskRecord struct {
+	Op    string                 `json:"op"`
+	Name  string                 `json:"name"`
+	Chunk *diskChunk             `json:"chunk,omitempty"`
+	Stats *docker.ContainerStats `json:"stats,omitempty"`
+}
+
+// diskChunk is a chunk of the history of a container as compressed in memory.
+type diskChunk struct {
+	Count   int       `json:"count"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	Data    []byte    `json:"data"`
+	Strings []string  `json:"strings,omitempty"`
+}
+
+func chunkRecord(name string, c *chunk) diskRecord {
+	return diskRecord{
+		Op:   opChunk,
+		Name: name,
+		Chunk: &diskChunk{
+			Count:   c.count,
+			First:   c.first,
+			Last:    c.last,
+			Data:    c.data.data,
+			Strings: c.strings,
+		},
+	}
+}
+
+// DiskStorage serves the stats from memory like MemoryStorage, and appends the
+// chunks of their history to segment files under dir as they are sealed, so
+// that history survives restarts. The chunks being written are only saved by
+// checkpoints and Close, so a crash loses up to a chunk of samples. Segments
+// are replayed when the storage is created, restoring the history of
+// containers but not the containers themselves, which are collected again
+// once the watcher updates them. Each segment starts with a checkpoint of the
+// stored histories, so the oldest segments can be removed once older than
+// retentionAge or when all of them exceed retentionSize bytes, 0 disabling
+// either limit.
+type DiskStorage struct {
+	*MemoryStorage
+	dir           string
+	retentionAge  time.Duration
+	retentionSize int64
+
+	segmentLock  sync.Mutex
+	segment      *os.File
+	segmentStart time.Time
+	segmentSize  int64
+	// checkpointSize is the part of segmentSize written by the checkpoint,
+	// which does not count against the share of the retention.
+	checkpointSize int64
+	// claimDeadline is when the restored histories which were not claimed
+	// by a container are dropped, zero once done.
+	claimDeadline time.Time
+}
+
+// NewDiskStorage restores the stats stored under dir within retentionAge and
+// opens a new segment.
+func NewDiskStorage(dir string, maxStatsLength int, memoryBudget int64, aggregationWindow time.Duration, windowValues WindowValuesFunc, retentionAge time.Duration, retentionSize int64) (Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failure creating %s: %v", dir, err)
+	}
+	d := &DiskStorage{
+		MemoryStorage: newMemoryStorage(maxStatsLength, memoryBudget, aggregationWindow, windowValues),
+		dir:           dir,
+		retentionAge:  retentionAge,
+		retentionSize: retentionSize,
+		claimDeadline: time.Now().Add(restoreGracePeriod),
+	}
+
+	// the segments which expired while the exporter was down are not restored
+	now := time.Now()
+	d.expire(now)
+	var cutoff time.Time
+	if retentionAge > 0 {
+		cutoff = now.Add(-retentionAge)
+	}
+	segments, err := d.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if err = d.replay(filepath.Join(dir, segment.Name()), cutoff); err != nil {
+			// the last record is truncated when the exporter died writing it
+			glog.Errorf("Failed to restore stats from %s: %v", segment.Name(), err)
+		}
+	}
+	glog.Infof("Restored the history of %d containers from %d segments in %s", len(d.MemoryStorage.chunks(false)), len(segments), dir)
+
+	d.segmentLock.Lock()
+	defer d.segmentLock.Unlock()
+	if err = d.rotate(now); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DiskStorage) AddStats(name string, stats *docker.ContainerStats) error {
+	d.dropUnclaimed()
+	sealed, err := d.MemoryStorage.addStats(name, stats)
+	if err != nil || sealed == nil {
+		return err
+	}
+	return d.append(chunkRecord(name, sealed))
+}
+
+func (d *DiskStorage) RemoveContainerInfo(name string) error {
+	if err := d.MemoryStorage.RemoveContainerInfo(name); err != nil {
+		return err
+	}
+	return d.append(diskRecord{Op: opRemove, Name: name})
+}
+
+// dropUnclaimed drops the restored histories of the containers the watcher
+// did not update within restoreGracePeriod.
+func (d *DiskStorage) dropUnclaimed() {
+	d.segmentLock.Lock()
+	expired := !d.claimDeadline.IsZero() && time.Now().After(d.claimDeadline)
+	if expired {
+		d.claimDeadline = time.Time{}
+	}
+	d.segmentLock.Unlock()
+	if !expired {
+		return
+	}
+
+	names := d.MemoryStorage.dropUnclaimed()
+	glog.V(2).Infof("Dropped the restored history of %d containers which are gone", len(names))
+	for _, name := range names {
+		if err := d.append(diskRecord{Op: opRemove, Name: name}); err != nil {
+			glog.Errorf("Failed to record the removal of %s: %v", name, err)
+		}
+	}
+}
+
+// Close saves the chunks being written and the host stats, and closes the
+// current segment.
+func (d *DiskStorage) Close() error {
+	d.segmentLock.Lock()
+	defer d.segmentLock.Unlock()
+	if d.segment == nil {
+		return nil
+	}
+	err := d.writeRecords(d.records(true))
+	if closeErr := d.segment.Close(); err == nil {
+		err = closeErr
+	}
+	d.segment = nil
+	return err
+}
+
+// segments lists the segment files of dir from the oldest.
+func (d *DiskStorage) segments() ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %s: %v", d.dir, err)
+	}
+	// names are zero padded creation times, and ReadDir sorts by name
+	var segments []os.FileInfo
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), segmentSuffix) {
+			segments = append(segments, f)
+		}
+	}
+	return segments, nil
+}
+
+// replay applies the records of a segment to the memory storage, skipping the
+// stats older than cutoff, which checkpoints may have copied to recent
+// segments.
+func (d *DiskStorage) replay(segmentFile string, cutoff time.Time) error {
+	f, err := os.Open(segmentFile)
+	if err != nil {
+		return fmt.Errorf("failure opening %s: %v", segmentFile, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		var r diskRecord
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("invalid record: %v", err)
+		}
+		switch r.Op {
+		case opChunk:
+			if r.Chunk == nil || r.Chunk.Count == 0 || r.Chunk.Last.Before(cutoff) {
+				continue
+			}
+			c := &chunk{
+				count:   r.Chunk.Count,
+				first:   r.Chunk.First,
+				last:    r.Chunk.Last,
+				data:    bitWriter{data: r.Chunk.Data},
+				strings: r.Chunk.Strings,
+			}
+			if err = d.MemoryStorage.restoreChunk(r.Name, c); err != nil {
+				return fmt.Errorf("invalid chunk of %s: %v", r.Name, err)
+			}
+		case opRemove:
+			d.MemoryStorage.RemoveContainerInfo(r.Name)
+		case opHost:
+			if r.Stats != nil && !r.Stats.Timestamp.Before(cutoff) {
+				d.MemoryStorage.UpdateHostStats(r.Name, r.Stats)
+			}
+		default:
+			return fmt.Errorf("unknown record operation %q", r.Op)
+		}
+	}
+	return scanner.Err()
+}
+
+// append writes a record to the current segment, rotating it first when it
+// holds its share of the retention.
+func (d *DiskStorage) append(r diskRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s record of %s: %v", r.Op, r.Name, err)
+	}
+	data = append(data, '\n')
+
+	d.segmentLock.Lock()
+	defer d.segmentLock.Unlock()
+	now := time.Now()
+	full := d.retentionSize > 0 && d.segmentSize-d.checkpointSize >= d.retentionSize/segmentsPerRetention
+	old := d.retentionAge > 0 && now.Sub(d.segmentStart) >= d.retentionAge/segmentsPerRetention
+	if d.segment == nil || full || old {
+		if err = d.rotate(now); err != nil {
+			return err
+		}
+	}
+	return d.write(data)
+}
+
+func (d *DiskStorage) write(data []byte) error {
+	n, err := d.segment.Write(data)
+	d.segmentSize += int64(n)
+	if err != nil {
+		return fmt.Errorf("couldn't write to %s: %v", d.segment.Name(), err)
+	}
+	return nil
+}
+
+// rotate opens a new segment starting with a checkpoint of the memory
+// storage, and removes the segments beyond the retention.
+func (d *DiskStorage) rotate(now time.Time) error {
+	if d.segment != nil {
+		d.segment.Close()
+		d.segment = nil
+	}
+
+	segmentFile := filepath.Join(d.dir, fmt.Sprintf("%020d%s", now.UnixNano(), segmentSuffix))
+	f, err := os.OpenFile(segmentFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failure opening %s: %v", segmentFile, err)
+	}
+	d.segment = f
+	d.segmentStart = now
+	d.segmentSize = 0
+
+	if err = d.checkpoint(); err != nil {
+		return err
+	}
+	d.checkpointSize = d.segmentSize
+	d.expire(now)
+	return nil
+}
+
+// checkpoint writes the histories and the host stats held in memory.
+func (d *DiskStorage) checkpoint() error {
+	return d.writeRecords(d.records(false))
+}
+
+// records returns the chunks of every history, only the ones being written
+// when open is true, and the host stats.
+func (d *DiskStorage) records(open bool) []diskRecord {
+	var records []diskRecord
+	for name, chunks := range d.MemoryStorage.chunks(open) {
+		for _, c := range chunks {
+			records = append(records, chunkRecord(name, c))
+		}
+	}
+	for target, stats := range d.MemoryStorage.GetHostStats() {
+		records = append(records, diskRecord{Op: opHost, Name: target, Stats: stats})
+	}
+	return records
+}
+
+func (d *DiskStorage) writeRecords(records []diskRecord) error {
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s record of %s: %v", r.Op, r.Name, err)
+		}
+		if err = d.write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expire removes the oldest segments beyond the retention, never the current
+// one if any.
+func (d *DiskStorage) expire(now time.Time) {
+	segments, err := d.segments()
+	if err != nil {
+		glog.Errorf("Failed to list segments: %v", err)
+		return
+	}
+
+	var size int64
+	for _, segment := range segments {
+		size += segment.Size()
+	}
+	var current string
+	if d.segment != nil {
+		current = filepath.Base(d.segment.Name())
+	}
+	for _, segment := range segments {
+		if segment.Name() == current {
+			break
+		}
+		tooOld := d.retentionAge > 0 && now.Sub(segment.ModTime()) > d.retentionAge
+		tooLarge := d.retentionSize > 0 && size > d.retentionSize
+		if !tooOld && !tooLarge {
+			break
+		}
+		if err = os.Remove(filepath.Join(d.dir, segment.Name())); err != nil {
+			glog.Errorf("Failed to remove segment %s: %v", segment.Name(), err)
+			continue
+		}
+		glog.V(2).Infof("Removed segment %s", segment.Name())
+		size -= segment.Size()
+	}
+}
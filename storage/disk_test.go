@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	info "github.com/google/cadvisor/info/v1"
+
+	"github.com/yanqing-exporter/container/docker"
+)
+
+func newTestDir(t *testing.T) string {
+	baseDir := os.Getenv("TEST_YQ_DIR")
+	if len(baseDir) == 0 {
+		baseDir = os.TempDir()
+	}
+	dir, err := ioutil.TempDir(baseDir, "yq_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newTestContainer(name string) *docker.ContainerInfo {
+	return &docker.ContainerInfo{
+		ContainerReference: info.ContainerReference{Name: name, Aliases: []string{"test"}},
+		Spec:               docker.ContainerSpec{Pid: 100, Ips: []string{"172.17.0.2"}},
+	}
+}
+
+func TestDiskStorageRestore(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskStorage(dir, 2, 0, 0, nil, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Truncate(time.Second)
+	for _, name := range []string{"/docker/test", "/docker/gone", "/docker/stopped"} {
+		s.UpdateContainerInfo(name, newTestContainer(name))
+		for i := 0; i < 3; i++ {
+			stats := &docker.ContainerStats{Timestamp: start.Add(time.Duration(i) * time.Second)}
+			stats.Tcp.Established = uint64(i)
+			if err = s.AddStats(name, stats); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.RemoveContainerInfo("/docker/gone")
+	s.UpdateHostStats(HostTarget, &docker.ContainerStats{Timestamp: start})
+	// the chunks being written are only saved on close
+	if d := s.(*DiskStorage); d.segmentSize != d.checkpointSize+int64(len(`{"op":"remove","name":"/docker/gone"}`)+1) {
+		t.Errorf("expected only the removal to be written, got %d bytes after the checkpoint", d.segmentSize-d.checkpointSize)
+	}
+	s.(*DiskStorage).Close()
+
+	// the exporter died writing a record
+	segments, err := s.(*DiskStorage).segments()
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("expected 1 segment, got %v: %v", segments, err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, segments[0].Name()), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"chunk","name":"/docker/test","chunk":{"cou`)
+	f.Close()
+
+	defer func(gracePeriod time.Duration) {
+		restoreGracePeriod = gracePeriod
+	}(restoreGracePeriod)
+	restoreGracePeriod = 0
+	restored, err := NewDiskStorage(dir, 2, 0, 0, nil, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.(*DiskStorage).Close()
+	// containers are not collected before the watcher updates them
+	if containers := restored.GetAllContainerInfo(); len(containers) != 0 {
+		t.Fatalf("expected no restored container, got %v", containers)
+	}
+	if _, ok := restored.GetHostStats()[HostTarget]; !ok {
+		t.Errorf("expected the host stats to be restored")
+	}
+
+	cinfo := newTestContainer("/docker/test")
+	cinfo.Spec.Pid = 200
+	restored.UpdateContainerInfo("/docker/test", cinfo)
+	stats, err := restored.GetLatestStats("/docker/test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[1].Tcp.Established != 2 || !stats[1].Timestamp.Equal(start.Add(2*time.Second)) {
+		t.Errorf("expected the 2 latest stats to be restored, got %+v", stats)
+	}
+	if err = restored.AddStats("/docker/test", &docker.ContainerStats{Timestamp: start.Add(3 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ = restored.GetLatestStats("/docker/test", 0); len(stats) != 2 || !stats[1].Timestamp.Equal(start.Add(3*time.Second)) {
+		t.Errorf("expected the stats to be added to the restored history, got %+v", stats)
+	}
+
+	// the history of containers which did not come back is dropped
+	for _, name := range []string{"/docker/gone", "/docker/stopped"} {
+		restored.UpdateContainerInfo(name, newTestContainer(name))
+		if stats, _ = restored.GetLatestStats(name, 0); len(stats) != 0 {
+			t.Errorf("expected the history of %s to be dropped, got %+v", name, stats)
+		}
+	}
+}
+
+func TestDiskStorageRetention(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	retentionSize := int64(16 * 1024)
+	s, err := NewDiskStorage(dir, 5, 0, 0, nil, 0, retentionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateContainerInfo("/docker/test", newTestContainer("/docker/test"))
+	start := time.Now()
+	for i := 0; i < 2000; i++ {
+		stats := &docker.ContainerStats{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		stats.Tcp.Established = uint64(i)
+		if err = s.AddStats("/docker/test", stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.(*DiskStorage).Close()
+
+	segments, err := s.(*DiskStorage).segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, segment := range segments {
+		size += segment.Size()
+	}
+	// the current segment goes past its share by its checkpoint and a chunk
+	if len(segments) < 2 || size > retentionSize+2*retentionSize/segmentsPerRetention+2*s.(*DiskStorage).checkpointSize {
+		t.Errorf("expected the segments to be rotated and removed, got %d segments of %d bytes", len(segments), size)
+	}
+
+	// the checkpoints keep the history once its first segment is removed
+	restored, err := NewDiskStorage(dir, 5, 0, 0, nil, 0, retentionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.(*DiskStorage).Close()
+	restored.UpdateContainerInfo("/docker/test", newTestContainer("/docker/test"))
+	stats, err := restored.GetLatestStats("/docker/test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 5 || stats[4].Tcp.Established != 1999 {
+		t.Errorf("expected the 5 latest stats to be restored, got %d", len(stats))
+	}
+	restored.(*DiskStorage).Close()
+
+	// nothing is restored once the exporter was down beyond the age limit
+	if segments, err = restored.(*DiskStorage).segments(); err != nil {
+		t.Fatal(err)
+	}
+	down := time.Now().Add(-2 * time.Hour)
+	for _, segment := range segments {
+		if err = os.Chtimes(filepath.Join(dir, segment.Name()), down, down); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired, err := NewDiskStorage(dir, 5, 0, 0, nil, time.Hour, retentionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expired.(*DiskStorage).Close()
+	expired.UpdateContainerInfo("/docker/test", newTestContainer("/docker/test"))
+	if stats, _ = expired.GetLatestStats("/docker/test", 0); len(stats) != 0 {
+		t.Errorf("expected the expired stats not to be restored, got %d", len(stats))
+	}
+	if segments, err = expired.(*DiskStorage).segments(); err != nil || len(segments) != 1 {
+		t.Errorf("expected only the new segment to be left, got %d", len(segments))
+	}
+}
+
+func TestDiskStorageRestoreCutoff(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskStorage(dir, 5, 0, 0, nil, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateContainerInfo("/docker/old", newTestContainer("/docker/old"))
+	s.UpdateContainerInfo("/docker/recent", newTestContainer("/docker/recent"))
+	now := time.Now()
+	s.AddStats("/docker/old", &docker.ContainerStats{Timestamp: now.Add(-2 * time.Hour)})
+	s.AddStats("/docker/recent", &docker.ContainerStats{Timestamp: now})
+	s.UpdateHostStats(HostTarget, &docker.ContainerStats{Timestamp: now.Add(-2 * time.Hour)})
+	s.(*DiskStorage).Close()
+
+	// the segment is recent, but holds stats older than the age limit
+	restored, err := NewDiskStorage(dir, 5, 0, 0, nil, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.(*DiskStorage).Close()
+	for name, expected := range map[string]int{"/docker/old": 0, "/docker/recent": 1} {
+		restored.UpdateContainerInfo(name, newTestContainer(name))
+		if stats, _ := restored.GetLatestStats(name, 0); len(stats) != expected {
+			t.Errorf("expected %d stats of %s to be restored, got %d", expected, name, len(stats))
+		}
+	}
+	if hostStats := restored.GetHostStats(); len(hostStats) != 0 {
+		t.Errorf("expected the old host stats not to be restored, got %d", len(hostStats))
+	}
+}
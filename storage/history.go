@@ -0,0 +1,773 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/yanqing-exporter/container/docker"
+)
+
+// chunkSamples is the number of samples of a chunk, 20 minutes of samples
+// collected every 10 seconds.
+const chunkSamples = 120
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// history holds the stats of a container compressed in chunks like Gorilla
+// series: timestamps as delta of deltas, and every number of the stats as the
+// xor with its value in the previous sample, which is a single bit for the
+// many values which do not change. The stats are walked by reflection so
+// that any field added to ContainerStats is stored as well, numbers being
+// identified by their position in the walk.
+type history struct {
+	chunks []*chunk
+	// skip is the number of samples of the first chunk which were trimmed.
+	skip int
+	// latest is the most recent sample, kept as added, using latestSize
+	// bytes.
+	latest     *docker.ContainerStats
+	latestSize int64
+	// updated orders the histories by their last update.
+	updated uint64
+}
+
+// chunk holds consecutive samples. It is sealed, without encoder, once full
+// or when restored from disk.
+type chunk struct {
+	count   int
+	first   time.Time
+	last    time.Time
+	data    bitWriter
+	strings []string
+	encoder *chunkEncoder
+}
+
+func (h *history) len() int {
+	n := -h.skip
+	for _, c := range h.chunks {
+		n += c.count
+	}
+	return n
+}
+
+// add inserts a sample, re-encoding the history when it is older than the
+// latest one.
+func (h *history) add(stats *docker.ContainerStats) error {
+	if h.latest != nil && stats.Timestamp.Before(h.latest.Timestamp) {
+		samples, err := h.samples(time.Time{}, time.Time{}, 0)
+		if err != nil {
+			return err
+		}
+		index := sort.Search(len(samples), func(index int) bool {
+			return samples[index].Timestamp.After(stats.Timestamp)
+		})
+		samples = append(samples, nil)
+		copy(samples[index+1:], samples[index:])
+		samples[index] = stats
+
+		rebuilt := &history{}
+		for _, s := range samples {
+			if err = rebuilt.append(s); err != nil {
+				return err
+			}
+		}
+		// the latest sample is kept as added rather than decoded
+		rebuilt.latest, rebuilt.latestSize = h.latest, h.latestSize
+		rebuilt.updated = h.updated
+		*h = *rebuilt
+		return nil
+	}
+	if err := h.append(stats); err != nil {
+		return err
+	}
+	h.latestSize = statsSize(stats)
+	return nil
+}
+
+func (h *history) append(stats *docker.ContainerStats) error {
+	// chunks restored from disk are sealed before they are full
+	if len(h.chunks) == 0 || h.chunks[len(h.chunks)-1].sealed() {
+		h.chunks = append(h.chunks, &chunk{encoder: newChunkEncoder()})
+	}
+	c := h.chunks[len(h.chunks)-1]
+	if err := c.add(stats); err != nil {
+		return err
+	}
+	h.latest = stats
+	return nil
+}
+
+// restore appends a chunk read back from disk, replacing the last chunk when
+// it is an earlier copy of the same one. Chunks overlapping the history are
+// dropped.
+func (h *history) restore(c *chunk) error {
+	if n := len(h.chunks); n > 0 {
+		last := h.chunks[n-1]
+		if c.first.Equal(last.first) && c.count > last.count {
+			h.chunks = h.chunks[:n-1]
+		} else if !c.first.After(last.last) {
+			return nil
+		}
+	}
+	decoded, err := c.decode()
+	if err != nil {
+		return err
+	}
+	h.chunks = append(h.chunks, c)
+	h.latest = decoded[len(decoded)-1]
+	h.latestSize = statsSize(h.latest)
+	return nil
+}
+
+// trim drops the oldest samples beyond max.
+func (h *history) trim(max int) {
+	n := h.len() - max
+	if n <= 0 {
+		return
+	}
+	h.skip += n
+	for len(h.chunks) > 0 && h.skip >= h.chunks[0].count {
+		h.skip -= h.chunks[0].count
+		h.chunks = h.chunks[1:]
+	}
+	if len(h.chunks) == 0 {
+		h.latest, h.latestSize = nil, 0
+	}
+}
+
+// evictChunk drops the oldest chunk, keeping the latest sample even once the
+// chunk being written is dropped.
+func (h *history) evictChunk() {
+	h.chunks = h.chunks[1:]
+	h.skip = 0
+}
+
+// size is the memory used by the chunks and the latest sample.
+func (h *history) size() int64 {
+	size := h.latestSize
+	for _, c := range h.chunks {
+		size += c.size()
+	}
+	return size
+}
+
+// samples decodes the samples from start to end included, zero times leaving
+// the range open, only the latest count of them when count is positive.
+func (h *history) samples(start, end time.Time, count int) ([]*docker.ContainerStats, error) {
+	var samples []*docker.ContainerStats
+	for i := len(h.chunks) - 1; i >= 0; i-- {
+		c := h.chunks[i]
+		if !end.IsZero() && c.first.After(end) {
+			continue
+		}
+		if !start.IsZero() && c.last.Before(start) {
+			break
+		}
+
+		decoded, err := c.decode()
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			decoded = decoded[h.skip:]
+		}
+		var selected []*docker.ContainerStats
+		for _, s := range decoded {
+			if (start.IsZero() || !s.Timestamp.Before(start)) && (end.IsZero() || !s.Timestamp.After(end)) {
+				selected = append(selected, s)
+			}
+		}
+		samples = append(selected, samples...)
+		if count > 0 && len(samples) >= count {
+			break
+		}
+	}
+	if count > 0 && len(samples) > count {
+		samples = samples[len(samples)-count:]
+	}
+	return samples, nil
+}
+
+func (c *chunk) add(stats *docker.ContainerStats) error {
+	if err := c.encoder.encode(c, stats); err != nil {
+		return err
+	}
+	if c.count == 0 {
+		c.first = stats.Timestamp
+	}
+	c.last = stats.Timestamp
+	c.count++
+	if c.count == chunkSamples {
+		// release the encoder state and the spare capacity of the data
+		c.encoder = nil
+		c.data.data = append([]byte(nil), c.data.data...)
+	}
+	return nil
+}
+
+// sealed tells whether samples can no longer be added to the chunk.
+func (c *chunk) sealed() bool {
+	return c.encoder == nil
+}
+
+// snapshot returns a copy of the chunk which is not modified by later
+// samples.
+func (c *chunk) snapshot() *chunk {
+	if c.sealed() {
+		return c
+	}
+	return &chunk{
+		count:   c.count,
+		first:   c.first,
+		last:    c.last,
+		data:    bitWriter{data: append([]byte(nil), c.data.data...), free: c.data.free},
+		strings: append([]string(nil), c.strings...),
+	}
+}
+
+func (c *chunk) size() int64 {
+	size := int64(cap(c.data.data))
+	for _, s := range c.strings {
+		size += int64(len(s))
+	}
+	if c.encoder != nil {
+		size += int64(len(c.encoder.values)*8 + len(c.encoder.leading) + len(c.encoder.trailing))
+	}
+	return size
+}
+
+func (c *chunk) decode() ([]*docker.ContainerStats, error) {
+	d := &chunkDecoder{
+		r:       bitReader{data: c.data.data},
+		strings: c.strings,
+	}
+	samples := make([]*docker.ContainerStats, c.count)
+	for i := range samples {
+		stats, err := d.decode()
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample %d of chunk: %v", i, err)
+		}
+		samples[i] = stats
+	}
+	return samples, nil
+}
+
+// codecState is the state shared by the encoder and decoder of a chunk.
+type codecState struct {
+	samples   int
+	timestamp int64
+	delta     int64
+	// values, leading and trailing are, by position, the previous value of
+	// numbers and the window of the meaningful bits of their last xor.
+	values   []uint64
+	leading  []uint8
+	trailing []uint8
+	position int
+}
+
+// next returns the position of the next number of the sample.
+func (s *codecState) next() int {
+	i := s.position
+	s.position++
+	if i == len(s.values) {
+		s.values = append(s.values, 0)
+		s.leading = append(s.leading, math.MaxUint8)
+		s.trailing = append(s.trailing, 0)
+	}
+	return i
+}
+
+type chunkEncoder struct {
+	codecState
+	w       *bitWriter
+	strings map[string]uint64
+	chunk   *chunk
+}
+
+func newChunkEncoder() *chunkEncoder {
+	return &chunkEncoder{strings: make(map[string]uint64)}
+}
+
+func (e *chunkEncoder) encode(c *chunk, stats *docker.ContainerStats) error {
+	e.w = &c.data
+	e.chunk = c
+	e.position = 0
+	e.encodeTimestamp(stats.Timestamp.UnixNano())
+	e.samples++
+	return walkStats(reflect.ValueOf(stats).Elem(), e)
+}
+
+// encodeTimestamp writes the first timestamp and delta in full, then the
+// delta of deltas which is 0 for samples collected on time.
+func (e *chunkEncoder) encodeTimestamp(t int64) {
+	switch e.samples {
+	case 0:
+		e.w.writeBits(uint64(t), 64)
+	case 1:
+		e.delta = t - e.timestamp
+		e.w.writeBits(uint64(e.delta), 64)
+	default:
+		delta := t - e.timestamp
+		dod := delta - e.delta
+		e.delta = delta
+		switch {
+		case dod == 0:
+			e.w.writeBits(0, 1)
+		case fitsBits(dod, 20):
+			e.w.writeBits(0x2, 2)
+			e.w.writeBits(uint64(dod), 20)
+		case fitsBits(dod, 32):
+			e.w.writeBits(0x6, 3)
+			e.w.writeBits(uint64(dod), 32)
+		default:
+			e.w.writeBits(0x7, 3)
+			e.w.writeBits(uint64(dod), 64)
+		}
+	}
+	e.timestamp = t
+}
+
+func (e *chunkEncoder) decoding() bool {
+	return false
+}
+
+// number writes the xor of v with the previous value at its position: a 0
+// bit when equal, else its meaningful bits, within the window of the
+// previous xor when they fit in it.
+func (e *chunkEncoder) number(v uint64) (uint64, error) {
+	i := e.next()
+	xor := v ^ e.values[i]
+	e.values[i] = v
+	if xor == 0 {
+		e.w.writeBits(0, 1)
+		return v, nil
+	}
+	e.w.writeBits(1, 1)
+
+	leading := uint8(bits.LeadingZeros64(xor))
+	trailing := uint8(bits.TrailingZeros64(xor))
+	if e.leading[i] != math.MaxUint8 && leading >= e.leading[i] && trailing >= e.trailing[i] {
+		e.w.writeBits(0, 1)
+		e.w.writeBits(xor>>e.trailing[i], uint(64-e.leading[i]-e.trailing[i]))
+		return v, nil
+	}
+	e.leading[i], e.trailing[i] = leading, trailing
+	meaningful := 64 - leading - trailing
+	e.w.writeBits(1, 1)
+	e.w.writeBits(uint64(leading), 6)
+	e.w.writeBits(uint64(meaningful-1), 6)
+	e.w.writeBits(xor>>trailing, uint(meaningful))
+	return v, nil
+}
+
+// text writes the index of s in the strings of the chunk.
+func (e *chunkEncoder) text(s string) (string, error) {
+	index, ok := e.strings[s]
+	if !ok {
+		index = uint64(len(e.chunk.strings))
+		e.strings[s] = index
+		e.chunk.strings = append(e.chunk.strings, s)
+	}
+	_, err := e.number(index)
+	return s, err
+}
+
+type chunkDecoder struct {
+	codecState
+	r       bitReader
+	strings []string
+}
+
+func (d *chunkDecoder) decode() (*docker.ContainerStats, error) {
+	d.position = 0
+	t, err := d.decodeTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	d.samples++
+	stats := &docker.ContainerStats{Timestamp: time.Unix(0, t)}
+	if err = walkStats(reflect.ValueOf(stats).Elem(), d); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (d *chunkDecoder) decodeTimestamp() (int64, error) {
+	switch d.samples {
+	case 0:
+		t, err := d.r.readBits(64)
+		d.timestamp = int64(t)
+		return d.timestamp, err
+	case 1:
+		delta, err := d.r.readBits(64)
+		d.delta = int64(delta)
+		d.timestamp += d.delta
+		return d.timestamp, err
+	}
+
+	var dod int64
+	prefix, err := d.r.readBits(1)
+	if err != nil {
+		return 0, err
+	}
+	if prefix == 1 {
+		var size uint
+		if prefix, err = d.r.readBits(1); err != nil {
+			return 0, err
+		}
+		if prefix == 0 {
+			size = 20
+		} else {
+			if prefix, err = d.r.readBits(1); err != nil {
+				return 0, err
+			}
+			size = 32
+			if prefix == 1 {
+				size = 64
+			}
+		}
+		v, err := d.r.readBits(size)
+		if err != nil {
+			return 0, err
+		}
+		dod = signExtend(v, size)
+	}
+	d.delta += dod
+	d.timestamp += d.delta
+	return d.timestamp, nil
+}
+
+func (d *chunkDecoder) decoding() bool {
+	return true
+}
+
+func (d *chunkDecoder) number(uint64) (uint64, error) {
+	i := d.next()
+	changed, err := d.r.readBits(1)
+	if err != nil || changed == 0 {
+		return d.values[i], err
+	}
+
+	window, err := d.r.readBits(1)
+	if err != nil {
+		return 0, err
+	}
+	if window == 1 {
+		leading, err := d.r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		meaningful, err := d.r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		d.leading[i] = uint8(leading)
+		d.trailing[i] = uint8(64 - leading - meaningful - 1)
+	}
+	xor, err := d.r.readBits(uint(64 - d.leading[i] - d.trailing[i]))
+	if err != nil {
+		return 0, err
+	}
+	d.values[i] ^= xor << d.trailing[i]
+	return d.values[i], nil
+}
+
+func (d *chunkDecoder) text(string) (string, error) {
+	index, err := d.number(0)
+	if err != nil {
+		return "", err
+	}
+	if index >= uint64(len(d.strings)) {
+		return "", fmt.Errorf("invalid string index %d", index)
+	}
+	return d.strings[index], nil
+}
+
+// codec encodes or decodes the values met walking the stats.
+type codec interface {
+	decoding() bool
+	number(v uint64) (uint64, error)
+	text(s string) (string, error)
+}
+
+// walkStats walks the fields of ContainerStats but its timestamp.
+func walkStats(v reflect.Value, c codec) error {
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Name == "Timestamp" {
+			continue
+		}
+		if err := walk(v.Field(i), c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk encodes or decodes v, numbers being written as uint64, pointers,
+// slices and maps as their presence or length followed by their elements,
+// map entries being sorted by key.
+func walk(v reflect.Value, c codec) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		var n uint64
+		if v.Bool() {
+			n = 1
+		}
+		n, err := c.number(n)
+		if c.decoding() {
+			v.SetBool(n != 0)
+		}
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := c.number(uint64(v.Int()))
+		if c.decoding() {
+			v.SetInt(int64(n))
+		}
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := c.number(v.Uint())
+		if c.decoding() {
+			v.SetUint(n)
+		}
+		return err
+	case reflect.Float32, reflect.Float64:
+		n, err := c.number(math.Float64bits(v.Float()))
+		if c.decoding() {
+			v.SetFloat(math.Float64frombits(n))
+		}
+		return err
+	case reflect.String:
+		s, err := c.text(v.String())
+		if c.decoding() {
+			v.SetString(s)
+		}
+		return err
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return walkTime(v, c)
+		}
+		for i := 0; i < v.NumField(); i++ {
+			// unexported fields can not be set
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if err := walk(v.Field(i), c); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := walk(v.Index(i), c); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Ptr:
+		present, err := c.number(boolNumber(!v.IsNil()))
+		if err != nil || present == 0 {
+			return err
+		}
+		if c.decoding() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return walk(v.Elem(), c)
+	case reflect.Slice:
+		n, err := walkLength(v, c)
+		if err != nil || n < 0 {
+			return err
+		}
+		if c.decoding() {
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+		}
+		for i := 0; i < n; i++ {
+			if err = walk(v.Index(i), c); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		return walkMap(v, c)
+	}
+	return fmt.Errorf("unsupported %s field", v.Type())
+}
+
+// walkLength walks the length of a slice or map, -1 for nil ones.
+func walkLength(v reflect.Value, c codec) (int, error) {
+	var n uint64
+	if !v.IsNil() {
+		n = uint64(v.Len()) + 1
+	}
+	n, err := c.number(n)
+	return int(n) - 1, err
+}
+
+func walkMap(v reflect.Value, c codec) error {
+	n, err := walkLength(v, c)
+	if err != nil || n < 0 {
+		return err
+	}
+
+	keyType, elemType := v.Type().Key(), v.Type().Elem()
+	if c.decoding() {
+		v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		for i := 0; i < n; i++ {
+			key, elem := reflect.New(keyType).Elem(), reflect.New(elemType).Elem()
+			if err = walk(key, c); err != nil {
+				return err
+			}
+			if err = walk(elem, c); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+		return nil
+	}
+
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return lessKey(keys[i], keys[j])
+	})
+	for _, k := range keys {
+		// copies are walked as map entries are not addressable
+		key, elem := reflect.New(keyType).Elem(), reflect.New(elemType).Elem()
+		key.Set(k)
+		elem.Set(v.MapIndex(k))
+		if err = walk(key, c); err != nil {
+			return err
+		}
+		if err = walk(elem, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statsSizer estimates the memory used by stats as added, counting a word per
+// number and the header and bytes of strings.
+type statsSizer struct {
+	size int64
+}
+
+func (s *statsSizer) decoding() bool {
+	return false
+}
+
+func (s *statsSizer) number(v uint64) (uint64, error) {
+	s.size += 8
+	return v, nil
+}
+
+func (s *statsSizer) text(str string) (string, error) {
+	s.size += 16 + int64(len(str))
+	return str, nil
+}
+
+// statsSize returns the estimated memory used by stats, their timestamp
+// included.
+func statsSize(stats *docker.ContainerStats) int64 {
+	s := &statsSizer{size: int64(reflect.TypeOf(stats.Timestamp).Size())}
+	// the fields which can not be walked are not stored either
+	walkStats(reflect.ValueOf(stats).Elem(), s)
+	return s.size
+}
+
+func walkTime(v reflect.Value, c codec) error {
+	t := v.Interface().(time.Time)
+	present, err := c.number(boolNumber(!t.IsZero()))
+	if err != nil || present == 0 {
+		return err
+	}
+	var nanos uint64
+	if !t.IsZero() {
+		nanos = uint64(t.UnixNano())
+	}
+	nanos, err = c.number(nanos)
+	if c.decoding() {
+		v.Set(reflect.ValueOf(time.Unix(0, int64(nanos))))
+	}
+	return err
+}
+
+func lessKey(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	}
+	return a.String() < b.String()
+}
+
+func boolNumber(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fitsBits tells whether v is a signed integer of size bits.
+func fitsBits(v int64, size uint) bool {
+	return v >= -(1<<(size-1)) && v < 1<<(size-1)
+}
+
+func signExtend(v uint64, size uint) int64 {
+	shift := 64 - size
+	return int64(v<<shift) >> shift
+}
+
+type bitWriter struct {
+	data []byte
+	// free is the number of bits left in the last byte of data.
+	free uint
+}
+
+// writeBits writes the size low bits of v, the most significant first.
+func (w *bitWriter) writeBits(v uint64, size uint) {
+	for size > 0 {
+		if w.free == 0 {
+			w.data = append(w.data, 0)
+			w.free = 8
+		}
+		n := size
+		if n > w.free {
+			n = w.free
+		}
+		b := byte(v>>(size-n)) & byte(1<<n-1)
+		w.data[len(w.data)-1] |= b << (w.free - n)
+		w.free -= n
+		size -= n
+	}
+}
+
+type bitReader struct {
+	data []byte
+	// pos is the number of bits read.
+	pos uint
+}
+
+func (r *bitReader) readBits(size uint) (uint64, error) {
+	var v uint64
+	for size > 0 {
+		index := r.pos / 8
+		if index >= uint(len(r.data)) {
+			return 0, fmt.Errorf("unexpected end of chunk")
+		}
+		left := 8 - r.pos%8
+		n := size
+		if n > left {
+			n = left
+		}
+		b := r.data[index] >> (left - n) & byte(1<<n-1)
+		v = v<<n | uint64(b)
+		r.pos += n
+		size -= n
+	}
+	return v, nil
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	info "github.com/google/cadvisor/info/v1"
+
+	"github.com/yanqing-exporter/collector/types"
+	"github.com/yanqing-exporter/container/docker"
+)
+
+// samplesPerHour is an hour of samples collected every 10 seconds.
+const samplesPerHour = 360
+
+// newTestStats returns the i-th sample of a busy container, collected about
+// every 10 seconds.
+func newTestStats(i int) *docker.ContainerStats {
+	jitter := time.Duration(i*7919%1000) * time.Microsecond
+	stats := &docker.ContainerStats{
+		Timestamp:   time.Unix(1500000000, 0).Add(time.Duration(i)*10*time.Second + jitter),
+		NetworkMode: "default",
+		Sysctl:      types.SysctlStat{Somaxconn: 128, RmemDefault: 212992, IpLocalPortRangeMin: 32768, IpLocalPortRangeMax: 60999},
+		TcpTimers:   types.TcpTimerStat{Retransmit: uint64(i % 3), Keepalive: 12},
+		Churn: &types.ConnectionChurnStat{
+			Interval: types.ChurnStat{InboundOpened: uint64(i % 5), InboundClosed: uint64(i % 4)},
+			Total:    types.ChurnStat{InboundOpened: uint64(i * 5), InboundClosed: uint64(i * 4)},
+		},
+		Fds:   &types.FdStat{Processes: 1, Sockets: uint64(120 + i%9), Files: 40, MaxOpen: uint64(160 + i%9), MaxLimit: 1048576},
+		Links: map[string]int{"eth0": 27},
+	}
+	stats.Fds.MaxUtilization = float64(stats.Fds.MaxOpen) / float64(stats.Fds.MaxLimit)
+	stats.Pids = []int{4242}
+	stats.Netns = 4026532198
+	stats.Tcp = info.TcpStat{Established: uint64(100 + i%7), Listen: 2, TimeWait: uint64(i * 3 % 50), CloseWait: 1}
+	stats.Udp = info.UdpStat{Listen: 1, RxQueued: uint64(i % 3)}
+	stats.TcpExt = types.TcpExtStat{TW: uint64(i * 31), DelayedACKLocked: uint64(i / 7), TCPTimeouts: uint64(i / 3)}
+	stats.TcpWithPort = types.TcpStatWithPort{Stats: map[int64]info.TcpStat{
+		80:  {Established: uint64(60 + i%5), Listen: 1},
+		443: {Established: uint64(40 + i%3), Listen: 1},
+	}}
+	stats.UdpWithPort = types.UdpStatWithPort{Stats: map[int64]types.UdpPortStat{
+		53: {Sockets: 1, Dropped: uint64(i / 50), RxQueueUtilization: float64(i%4) / 10},
+	}}
+	stats.Peers = types.PeerStat{Ips: []types.PeerConnections{
+		{Ip: "10.244.1.3", Total: uint64(50 + i%5), States: map[string]uint64{"established": uint64(50 + i%5)}, Workload: &types.Workload{Kind: "Deployment", Namespace: "default", Name: "db"}},
+		{Ip: "10.244.2.8", Total: 12, States: map[string]uint64{"established": 11, "timewait": 1}},
+	}}
+	stats.ConnectionAges = []types.ConnectionAgeStat{{
+		State:   "established",
+		Count:   uint64(100 + i%7),
+		Sum:     float64(i) * 1234.5,
+		Max:     float64(i * 10),
+		Buckets: []types.AgeBucket{{UpperBound: 60, Count: 3}, {UpperBound: 3600, Count: uint64(100 + i%7)}},
+	}}
+	stats.Nested = []docker.NetworkStats{{Netns: 4026532300, Pids: []int{4300}, Tcp: info.TcpStat{Established: uint64(i % 2)}}}
+	return stats
+}
+
+func TestHistory(t *testing.T) {
+	var expected []*docker.ContainerStats
+	h := &history{}
+	for i := 0; i < 3*chunkSamples+10; i++ {
+		stats := newTestStats(i)
+		if i >= 200 {
+			// a collection which took long
+			stats.Timestamp = stats.Timestamp.Add(90 * time.Second)
+		}
+		expected = append(expected, stats)
+		if err := h.add(stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	samples, err := h.samples(time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != len(expected) {
+		t.Fatalf("expected %d samples, got %d", len(expected), len(samples))
+	}
+	for i := range samples {
+		if !reflect.DeepEqual(samples[i], expected[i]) {
+			t.Fatalf("sample %d differs once decoded:\nexpected %+v\ngot      %+v", i, expected[i], samples[i])
+		}
+	}
+
+	h.trim(chunkSamples + 5)
+	if h.len() != chunkSamples+5 || len(h.chunks) != 2 || h.latest != expected[len(expected)-1] {
+		t.Errorf("expected %d samples in 2 chunks, got %d in %d", chunkSamples+5, h.len(), len(h.chunks))
+	}
+	samples, err = h.samples(time.Time{}, expected[len(expected)-1].Timestamp, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || !reflect.DeepEqual(samples[0], expected[len(expected)-3]) {
+		t.Errorf("expected the 3 latest samples, got %d", len(samples))
+	}
+}
+
+func TestHistoryOutOfOrder(t *testing.T) {
+	var expected []*docker.ContainerStats
+	for i := 0; i < chunkSamples+20; i++ {
+		expected = append(expected, newTestStats(i))
+	}
+	added := make([]*docker.ContainerStats, len(expected))
+	copy(added, expected)
+	rand.New(rand.NewSource(1)).Shuffle(len(added), func(i, j int) {
+		added[i], added[j] = added[j], added[i]
+	})
+
+	h := &history{}
+	for _, stats := range added {
+		if err := h.add(stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	samples, err := h.samples(time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sort.SliceIsSorted(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) }) {
+		t.Errorf("expected samples sorted by timestamp")
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("expected the samples added out of order to be decoded in order")
+	}
+	if h.latest != expected[len(expected)-1] {
+		t.Errorf("expected the latest sample to be kept as added")
+	}
+}
+
+// heapSize measures the memory kept by build.
+func heapSize(build func() interface{}) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	kept := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(kept)
+	if after.HeapAlloc < before.HeapAlloc {
+		return 0
+	}
+	return after.HeapAlloc - before.HeapAlloc
+}
+
+func BenchmarkHistoryAdd(b *testing.B) {
+	samples := make([]*docker.ContainerStats, samplesPerHour)
+	for i := range samples {
+		samples[i] = newTestStats(i)
+	}
+	b.ResetTimer()
+	h := &history{}
+	for i := 0; i < b.N; i++ {
+		if err := h.add(samples[i%samplesPerHour]); err != nil {
+			b.Fatal(err)
+		}
+		if i%samplesPerHour == samplesPerHour-1 {
+			h = &history{}
+		}
+	}
+}
+
+// BenchmarkHistoryDecode decodes an hour of stats of a container.
+func BenchmarkHistoryDecode(b *testing.B) {
+	h := &history{}
+	for i := 0; i < samplesPerHour; i++ {
+		h.add(newTestStats(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.samples(time.Time{}, time.Time{}, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkHistoryMemory reports the memory of an hour of stats of a
+// container once compressed, to compare with BenchmarkRawMemory.
+func BenchmarkHistoryMemory(b *testing.B) {
+	var size uint64
+	for i := 0; i < b.N; i++ {
+		size += heapSize(func() interface{} {
+			h := &history{}
+			for j := 0; j < samplesPerHour; j++ {
+				h.add(newTestStats(j))
+			}
+			return h
+		})
+	}
+	b.ReportMetric(float64(size)/float64(b.N), "bytes/container-hour")
+}
+
+// BenchmarkRawMemory reports the memory of an hour of stats of a container
+// kept as a slice of ContainerStats.
+func BenchmarkRawMemory(b *testing.B) {
+	var size uint64
+	for i := 0; i < b.N; i++ {
+		size += heapSize(func() interface{} {
+			var samples []*docker.ContainerStats
+			for j := 0; j < samplesPerHour; j++ {
+				samples = append(samples, newTestStats(j))
+			}
+			return samples
+		})
+	}
+	b.ReportMetric(float64(size)/float64(b.N), "bytes/container-hour")
+}
@@ -4,22 +4,85 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/yanqing-exporter/container/docker"
 )
 
+// Targets of the statistics of the host network namespace.
+const (
+	// HostTarget is the whole root network namespace.
+	HostTarget = "host"
+	// UnattributedTarget is the part of the root network namespace which is
+	// not owned by any host network container.
+	UnattributedTarget = "unattributed"
+)
+
 type Storage interface {
+	// GetContainerInfo and GetAllContainerInfo return containers with their
+	// latest stats only, their history being read with GetStatsRange. The
+	// containers, their stats and the map are read-only snapshots shared
+	// between callers, which updates replace rather than modify.
 	GetContainerInfo(name string) (*docker.ContainerInfo, error)
 	GetAllContainerInfo() map[string]*docker.ContainerInfo
 	UpdateContainerInfo(name string, cinfo *docker.ContainerInfo) error
 	AddStats(name string, stats *docker.ContainerStats) error
+	// GetStatsRange returns the stats of a container from start to end
+	// included, zero times leaving the range open, and only the latest count
+	// of them when count is positive.
+	GetStatsRange(name string, start, end time.Time, count int) ([]*docker.ContainerStats, error)
+	// GetLatestStats returns the latest count stats of a container.
+	GetLatestStats(name string, count int) ([]*docker.ContainerStats, error)
 	RemoveContainerInfo(name string) error
+	GetHostStats() map[string]*docker.ContainerStats
+	UpdateHostStats(target string, stats *docker.ContainerStats) error
+	// GetWindowAggregates returns the aggregates of the values of the stats
+	// of a container added over the aggregation window ending with its
+	// latest ones.
+	GetWindowAggregates(name string) ([]WindowAggregate, error)
+	// GetHostWindowAggregates returns the aggregates of the host stats added
+	// over the aggregation window by target.
+	GetHostWindowAggregates() map[string][]WindowAggregate
+	// GetUsage returns the memory used by the stats.
+	GetUsage() Usage
+}
+
+// Usage is the memory used by the compressed history of the stats, the
+// latest stats of containers and hosts, and the aggregates of the window.
+// Samples are evicted once Bytes exceed Budget.
+type Usage struct {
+	Bytes          int64
+	Samples        int
+	Budget         int64
+	EvictedSamples uint64
 }
 
+// MemoryStorage keeps the history of the stats of containers compressed, and
+// their latest stats as added. When the storage exceeds memoryBudget bytes,
+// the oldest samples of the least recently updated containers are evicted.
+// The values given by windowValues for the stats added over the last
+// aggregationWindow are aggregated as well, so that collections between
+// scrapes are not missed.
 type MemoryStorage struct {
-	maxStatsLength   int
-	lock             sync.RWMutex
-	containerInfoMap map[string]*docker.ContainerInfo
+	maxStatsLength    int
+	memoryBudget      int64
+	aggregationWindow time.Duration
+	windowValues      WindowValuesFunc
+	lock              sync.RWMutex
+	containerInfoMap  map[string]*docker.ContainerInfo
+	histories         map[string]*history
+	hostStats         map[string]*docker.ContainerStats
+	hostSizes         map[string]int64
+	windows           map[string]*window
+	hostWindows       map[string]*window
+	// updates orders the updates of histories.
+	updates uint64
+	usage   Usage
+	// version counts the changes of containerInfoMap, snapshot being a copy
+	// of it at snapshotVersion.
+	version         uint64
+	snapshot        map[string]*docker.ContainerInfo
+	snapshotVersion uint64
 }
 
 func (m *MemoryStorage) GetContainerInfo(name string) (*docker.ContainerInfo, error) {
@@ -34,13 +97,23 @@ func (m *MemoryStorage) GetContainerInfo(name string) (*docker.ContainerInfo, er
 
 func (m *MemoryStorage) GetAllContainerInfo() map[string]*docker.ContainerInfo {
 	m.lock.RLock()
-	defer m.lock.RUnlock()
-	containers := make(map[string]*docker.ContainerInfo, len(m.containerInfoMap))
+	if m.snapshot != nil && m.snapshotVersion == m.version {
+		defer m.lock.RUnlock()
+		return m.snapshot
+	}
+	m.lock.RUnlock()
 
-	for name, cont := range m.containerInfoMap {
-		containers[name] = cont
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.snapshot == nil || m.snapshotVersion != m.version {
+		containers := make(map[string]*docker.ContainerInfo, len(m.containerInfoMap))
+		for name, cont := range m.containerInfoMap {
+			containers[name] = cont
+		}
+		m.snapshot = containers
+		m.snapshotVersion = m.version
 	}
-	return containers
+	return m.snapshot
 }
 
 func (m *MemoryStorage) UpdateContainerInfo(name string, cinfo *docker.ContainerInfo) error {
@@ -51,59 +124,292 @@ func (m *MemoryStorage) UpdateContainerInfo(name string, cinfo *docker.Container
 		Spec:               cinfo.Spec,
 	}
 	if ret, ok := m.containerInfoMap[name]; ok {
-		c.Stats = make([]*docker.ContainerStats, len(ret.Stats))
-		copy(c.Stats, ret.Stats)
+		c.Stats = ret.Stats
 	}
 	m.containerInfoMap[name] = c
+	m.version++
 	return nil
 }
 
 func (m *MemoryStorage) AddStats(name string, stats *docker.ContainerStats) error {
-	var cinfo *docker.ContainerInfo
-	var ok bool
-
-	err := func() error {
-		m.lock.Lock()
-		defer m.lock.Unlock()
-		if cinfo, ok = m.containerInfoMap[name]; !ok {
-			return fmt.Errorf("unable to find data for container %v", name)
-		}
+	_, err := m.addStats(name, stats)
+	return err
+}
+
+// addStats adds stats to the history of a container, and returns the chunk
+// they sealed if any.
+func (m *MemoryStorage) addStats(name string, stats *docker.ContainerStats) (*chunk, error) {
+	values := m.valuesToAggregate(stats)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cinfo, ok := m.containerInfoMap[name]
+	if !ok {
+		return nil, fmt.Errorf("unable to find data for container %v", name)
+	}
+
+	h, ok := m.histories[name]
+	if !ok {
+		h = &history{}
+		m.histories[name] = h
+	}
+	var open *chunk
+	if n := len(h.chunks); n > 0 && !h.chunks[n-1].sealed() {
+		open = h.chunks[n-1]
+	}
+	size, samples := h.size(), h.len()
+	err := h.add(stats)
+	if err == nil && m.maxStatsLength >= 0 {
+		h.trim(m.maxStatsLength)
+	}
+	m.updates++
+	h.updated = m.updates
+	m.usage.Bytes += h.size() - size
+	m.usage.Samples += h.len() - samples
+	if err != nil {
+		return nil, fmt.Errorf("couldn't store stats of container %v: %v", name, err)
+	}
+	if values != nil {
+		m.windows[name] = m.addToWindow(m.windows[name], stats.Timestamp, values)
+	}
+	if m.memoryBudget > 0 && m.usage.Bytes > m.memoryBudget {
+		m.evict()
+	}
+	var sealed *chunk
+	if open != nil && open.sealed() {
+		sealed = open
+	}
 
-		if len(cinfo.Stats) == 0 || !stats.Timestamp.Before(cinfo.Stats[len(cinfo.Stats)-1].Timestamp) {
-			cinfo.Stats = append(cinfo.Stats, stats)
-		} else {
-			index := sort.Search(len(cinfo.Stats), func(index int) bool {
-				return cinfo.Stats[index].Timestamp.After(stats.Timestamp)
-			})
-			cinfo.Stats = append(cinfo.Stats, &docker.ContainerStats{})
-			copy(cinfo.Stats[index+1:], cinfo.Stats[index:])
-			cinfo.Stats[index] = stats
+	// readers may hold the previous container
+	c := &docker.ContainerInfo{
+		ContainerReference: cinfo.ContainerReference,
+		Spec:               cinfo.Spec,
+	}
+	if h.latest != nil {
+		c.Stats = []*docker.ContainerStats{h.latest}
+	}
+	m.containerInfoMap[name] = c
+	m.version++
+	return sealed, nil
+}
+
+// valuesToAggregate returns the values of stats to aggregate over the window,
+// nil when disabled.
+func (m *MemoryStorage) valuesToAggregate(stats *docker.ContainerStats) []WindowValue {
+	if m.aggregationWindow <= 0 || m.windowValues == nil {
+		return nil
+	}
+	return m.windowValues(stats)
+}
+
+// addToWindow aggregates values in w, created when nil, and counts the memory
+// it uses.
+func (m *MemoryStorage) addToWindow(w *window, t time.Time, values []WindowValue) *window {
+	if w == nil {
+		w = newWindow(m.aggregationWindow)
+	}
+	bytes := w.bytes
+	w.add(t, values)
+	m.usage.Bytes += w.bytes - bytes
+	return w
+}
+
+// restoreChunk adds a chunk read back from disk to the history of a
+// container, which is only listed once the container is updated.
+func (m *MemoryStorage) restoreChunk(name string, c *chunk) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	h, ok := m.histories[name]
+	if !ok {
+		h = &history{}
+		m.histories[name] = h
+	}
+	size, samples := h.size(), h.len()
+	err := h.restore(c)
+	if err == nil && m.maxStatsLength >= 0 {
+		h.trim(m.maxStatsLength)
+	}
+	m.usage.Bytes += h.size() - size
+	m.usage.Samples += h.len() - samples
+	if len(h.chunks) == 0 {
+		delete(m.histories, name)
+	}
+	return err
+}
+
+// chunks returns copies of the chunks of every history, only the chunks
+// being written when open is true.
+func (m *MemoryStorage) chunks(open bool) map[string][]*chunk {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	chunks := make(map[string][]*chunk, len(m.histories))
+	for name, h := range m.histories {
+		for _, c := range h.chunks {
+			if !open || !c.sealed() {
+				chunks[name] = append(chunks[name], c.snapshot())
+			}
 		}
+	}
+	return chunks
+}
 
-		if m.maxStatsLength >= 0 && len(cinfo.Stats) > m.maxStatsLength {
-			startIndex := len(cinfo.Stats) - m.maxStatsLength
-			cinfo.Stats = cinfo.Stats[startIndex:]
+// dropUnclaimed removes the histories restored for containers which have not
+// been updated since, and returns their names.
+func (m *MemoryStorage) dropUnclaimed() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var names []string
+	for name, h := range m.histories {
+		if _, ok := m.containerInfoMap[name]; ok {
+			continue
 		}
-		return nil
-	}()
+		m.usage.Bytes -= h.size()
+		m.usage.Samples -= h.len()
+		delete(m.histories, name)
+		names = append(names, name)
+	}
+	return names
+}
 
-	if nil != err {
-		return err
+func (m *MemoryStorage) GetWindowAggregates(name string) ([]WindowAggregate, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if _, ok := m.containerInfoMap[name]; !ok {
+		return nil, fmt.Errorf("unable to find data for container %v", name)
+	}
+	w, ok := m.windows[name]
+	if !ok {
+		return nil, nil
 	}
+	return w.aggregates(), nil
+}
 
-	return nil
+func (m *MemoryStorage) GetHostWindowAggregates() map[string][]WindowAggregate {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	hostWindows := make(map[string][]WindowAggregate, len(m.hostWindows))
+	for target, w := range m.hostWindows {
+		hostWindows[target] = w.aggregates()
+	}
+	return hostWindows
+}
+
+func (m *MemoryStorage) GetStatsRange(name string, start, end time.Time, count int) ([]*docker.ContainerStats, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if _, ok := m.containerInfoMap[name]; !ok {
+		return nil, fmt.Errorf("unable to find data for container %v", name)
+	}
+	h, ok := m.histories[name]
+	if !ok {
+		return nil, nil
+	}
+	return h.samples(start, end, count)
+}
+
+// evict drops the oldest chunks of the least recently updated histories until
+// the storage fits in the budget. The chunks being written are only dropped,
+// least recently updated first, once every other chunk was, the latest stats
+// being kept.
+func (m *MemoryStorage) evict() {
+	histories := make([]*history, 0, len(m.histories))
+	for _, h := range m.histories {
+		histories = append(histories, h)
+	}
+	sort.Slice(histories, func(i, j int) bool {
+		return histories[i].updated < histories[j].updated
+	})
+
+	for _, keep := range []int{1, 0} {
+		for _, h := range histories {
+			for len(h.chunks) > keep && m.usage.Bytes > m.memoryBudget {
+				size, samples := h.size(), h.len()
+				h.evictChunk()
+				m.usage.Bytes -= size - h.size()
+				m.usage.Samples -= samples - h.len()
+				m.usage.EvictedSamples += uint64(samples - h.len())
+			}
+			if m.usage.Bytes <= m.memoryBudget {
+				return
+			}
+		}
+	}
+}
+
+func (m *MemoryStorage) GetLatestStats(name string, count int) ([]*docker.ContainerStats, error) {
+	return m.GetStatsRange(name, time.Time{}, time.Time{}, count)
 }
 
 func (m *MemoryStorage) RemoveContainerInfo(name string) error {
 	m.lock.Lock()
+	if h, ok := m.histories[name]; ok {
+		m.usage.Bytes -= h.size()
+		m.usage.Samples -= h.len()
+	}
+	if w, ok := m.windows[name]; ok {
+		m.usage.Bytes -= w.bytes
+	}
 	delete(m.containerInfoMap, name)
+	delete(m.histories, name)
+	delete(m.windows, name)
+	m.version++
+	m.lock.Unlock()
+	return nil
+}
+
+func (m *MemoryStorage) GetHostStats() map[string]*docker.ContainerStats {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	hostStats := make(map[string]*docker.ContainerStats, len(m.hostStats))
+
+	for target, stats := range m.hostStats {
+		hostStats[target] = stats
+	}
+	return hostStats
+}
+
+func (m *MemoryStorage) UpdateHostStats(target string, stats *docker.ContainerStats) error {
+	values := m.valuesToAggregate(stats)
+	size := statsSize(stats)
+	m.lock.Lock()
+	m.hostStats[target] = stats
+	m.usage.Bytes += size - m.hostSizes[target]
+	m.hostSizes[target] = size
+	if values != nil {
+		m.hostWindows[target] = m.addToWindow(m.hostWindows[target], stats.Timestamp, values)
+	}
+	if m.memoryBudget > 0 && m.usage.Bytes > m.memoryBudget {
+		m.evict()
+	}
 	m.lock.Unlock()
 	return nil
 }
 
-func New(maxStatsLength int) Storage {
+func (m *MemoryStorage) GetUsage() Usage {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.usage
+}
+
+// New creates a MemoryStorage keeping maxStatsLength stats per container, and
+// at most memoryBudget bytes of history across containers, 0 for no limit.
+// The windowValues of the stats of the last aggregationWindow are aggregated,
+// 0 disabling it.
+func New(maxStatsLength int, memoryBudget int64, aggregationWindow time.Duration, windowValues WindowValuesFunc) Storage {
+	return newMemoryStorage(maxStatsLength, memoryBudget, aggregationWindow, windowValues)
+}
+
+func newMemoryStorage(maxStatsLength int, memoryBudget int64, aggregationWindow time.Duration, windowValues WindowValuesFunc) *MemoryStorage {
 	return &MemoryStorage{
-		maxStatsLength:   maxStatsLength,
-		containerInfoMap: make(map[string]*docker.ContainerInfo, 0),
+		maxStatsLength:    maxStatsLength,
+		memoryBudget:      memoryBudget,
+		aggregationWindow: aggregationWindow,
+		windowValues:      windowValues,
+		usage:             Usage{Budget: memoryBudget},
+		containerInfoMap:  make(map[string]*docker.ContainerInfo, 0),
+		histories:         make(map[string]*history),
+		hostStats:         make(map[string]*docker.ContainerStats, 0),
+		hostSizes:         make(map[string]int64),
+		windows:           make(map[string]*window),
+		hostWindows:       make(map[string]*window),
 	}
 }
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yanqing-exporter/container/docker"
+)
+
+func TestGetStatsRange(t *testing.T) {
+	s := New(-1, 0, 0, nil)
+	s.UpdateContainerInfo("/docker/test", newTestContainer("/docker/test"))
+	start := time.Now().Truncate(time.Second)
+	// added out of order
+	for _, i := range []int{0, 1, 2, 4, 3} {
+		stats := &docker.ContainerStats{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		stats.Tcp.Established = uint64(i)
+		s.AddStats("/docker/test", stats)
+	}
+
+	at := func(i int) time.Time {
+		return start.Add(time.Duration(i) * time.Second)
+	}
+	tests := []struct {
+		start    time.Time
+		end      time.Time
+		count    int
+		expected []uint64
+	}{
+		{time.Time{}, time.Time{}, 0, []uint64{0, 1, 2, 3, 4}},
+		{at(1), at(3), 0, []uint64{1, 2, 3}},
+		{at(1), time.Time{}, 2, []uint64{3, 4}},
+		{time.Time{}, at(2), 2, []uint64{1, 2}},
+		{at(1).Add(time.Millisecond), at(2).Add(-time.Millisecond), 0, nil},
+		{at(3), at(1), 0, nil},
+		{at(5), time.Time{}, 0, nil},
+	}
+	for _, test := range tests {
+		stats, err := s.GetStatsRange("/docker/test", test.start, test.end, test.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var established []uint64
+		for _, s := range stats {
+			established = append(established, s.Tcp.Established)
+		}
+		if len(established) != len(test.expected) {
+			t.Errorf("expected stats %v from %v to %v, got %v", test.expected, test.start, test.end, established)
+			continue
+		}
+		for i := range established {
+			if established[i] != test.expected[i] {
+				t.Errorf("expected stats %v from %v to %v, got %v", test.expected, test.start, test.end, established)
+				break
+			}
+		}
+	}
+
+	latest, err := s.GetLatestStats("/docker/test", 1)
+	if err != nil || len(latest) != 1 || latest[0].Tcp.Established != 4 {
+		t.Errorf("expected the latest stats, got %v: %v", latest, err)
+	}
+	if _, err = s.GetLatestStats("/docker/unknown", 1); err == nil {
+		t.Errorf("expected an error for an unknown container")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	m := newMemoryStorage(-1, 0, 0, nil)
+	for _, name := range []string{"/docker/idle", "/docker/busy"} {
+		m.UpdateContainerInfo(name, newTestContainer(name))
+		for i := 0; i < 3*chunkSamples; i++ {
+			m.AddStats(name, newTestStats(i))
+		}
+	}
+	m.AddStats("/docker/busy", newTestStats(3*chunkSamples))
+	usage := m.GetUsage()
+	if usage.Samples != 6*chunkSamples+1 || usage.EvictedSamples != 0 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	chunkSize := m.histories["/docker/idle"].chunks[0].size()
+
+	// the idle container was updated first and loses its sealed chunks first
+	m.memoryBudget = usage.Bytes - chunkSize/2
+	m.AddStats("/docker/busy", newTestStats(3*chunkSamples+1))
+	usage = m.GetUsage()
+	if usage.Bytes > m.memoryBudget || usage.EvictedSamples != chunkSamples {
+		t.Errorf("expected a chunk to be evicted, got %+v", usage)
+	}
+	if l := m.histories["/docker/idle"].len(); l != 2*chunkSamples {
+		t.Errorf("expected the idle container to keep %d samples, got %d", 2*chunkSamples, l)
+	}
+	if l := m.histories["/docker/busy"].len(); l != 3*chunkSamples+2 {
+		t.Errorf("expected the busy container to keep %d samples, got %d", 3*chunkSamples+2, l)
+	}
+
+	// the last chunks are evicted once the others are, least recently
+	// updated first
+	idle, busy := m.histories["/docker/idle"], m.histories["/docker/busy"]
+	var sealed int64
+	for _, h := range []*history{idle, busy} {
+		for _, c := range h.chunks[:len(h.chunks)-1] {
+			sealed += c.size()
+		}
+	}
+	m.memoryBudget = usage.Bytes - sealed - 1
+	m.evict()
+	if len(idle.chunks) != 0 || len(busy.chunks) != 1 || busy.chunks[0].sealed() {
+		t.Errorf("expected only the chunk being written by the busy container to be left, got %d and %d chunks", len(idle.chunks), len(busy.chunks))
+	}
+	if usage = m.GetUsage(); usage.Samples != 2 || usage.EvictedSamples != 6*chunkSamples {
+		t.Errorf("expected 2 samples left, got %+v", usage)
+	}
+
+	m.memoryBudget = 1
+	m.evict()
+	if len(busy.chunks) != 0 {
+		t.Errorf("expected the chunk being written to be evicted, got %d chunks", len(busy.chunks))
+	}
+	usage = m.GetUsage()
+	if usage.Samples != 0 || usage.Bytes != idle.latestSize+busy.latestSize || idle.latestSize == 0 {
+		t.Errorf("expected only the latest stats to be left, got %+v", usage)
+	}
+	if stats := m.GetAllContainerInfo()["/docker/busy"].Stats; len(stats) != 1 || stats[0] != busy.latest {
+		t.Errorf("expected the latest stats to be kept, got %v", stats)
+	}
+
+	m.RemoveContainerInfo("/docker/idle")
+	m.RemoveContainerInfo("/docker/busy")
+	if usage = m.GetUsage(); usage.Bytes != 0 || usage.Samples != 0 {
+		t.Errorf("expected no usage once containers are removed, got %+v", usage)
+	}
+}
+
+func TestWindowAggregates(t *testing.T) {
+	established := func(stats *docker.ContainerStats) []WindowValue {
+		return []WindowValue{{Metric: "established", Value: float64(stats.Tcp.Established)}}
+	}
+	m := newMemoryStorage(1, 0, 30*time.Second, established)
+	m.UpdateContainerInfo("/docker/test", newTestContainer("/docker/test"))
+	start := time.Now().Truncate(time.Second)
+	// added out of order, every 10 seconds
+	for _, i := range []int{0, 1, 3, 2, 4} {
+		stats := &docker.ContainerStats{Timestamp: start.Add(time.Duration(i) * 10 * time.Second)}
+		stats.Tcp.Established = uint64(i)
+		m.AddStats("/docker/test", stats)
+		m.UpdateHostStats(HostTarget, stats)
+	}
+
+	aggregates, err := m.GetWindowAggregates("/docker/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []WindowAggregate{{Metric: "established", Min: 2, Max: 4, Sum: 9, Count: 3}}
+	if !reflect.DeepEqual(aggregates, expected) {
+		t.Errorf("expected the aggregates of the last 30 seconds whatever the history length, got %+v", aggregates)
+	}
+	if hostAggregates := m.GetHostWindowAggregates()[HostTarget]; !reflect.DeepEqual(hostAggregates, expected) {
+		t.Errorf("expected the aggregates of the host stats of the last 30 seconds, got %+v", hostAggregates)
+	}
+	hostBytes := m.hostWindows[HostTarget].bytes
+	if usage := m.GetUsage(); hostBytes == 0 || usage.Bytes < 2*hostBytes {
+		t.Errorf("expected the windows to be counted in the usage, got %+v", usage)
+	}
+
+	// the series are aggregated once per bucket whatever the collections
+	for i := 0; i < 100; i++ {
+		stats := &docker.ContainerStats{Timestamp: start.Add(40*time.Second + time.Duration(i)*time.Millisecond)}
+		m.UpdateHostStats(HostTarget, stats)
+	}
+	if bytes := m.hostWindows[HostTarget].bytes; bytes != hostBytes {
+		t.Errorf("expected the window to keep using %d bytes, got %d", hostBytes, bytes)
+	}
+
+	m.RemoveContainerInfo("/docker/test")
+	if _, err = m.GetWindowAggregates("/docker/test"); err == nil {
+		t.Errorf("expected an error for a removed container")
+	}
+	if usage := m.GetUsage(); usage.Bytes != hostBytes+m.hostSizes[HostTarget] {
+		t.Errorf("expected only the host stats and window to be left, got %+v", usage)
+	}
+	if aggregates, _ = New(1, 0, 0, established).GetWindowAggregates("/docker/test"); aggregates != nil {
+		t.Errorf("expected no window when disabled")
+	}
+}
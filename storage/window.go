@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"strings"
+	"time"
+
+	"github.com/yanqing-exporter/container/docker"
+)
+
+// windowBuckets is the number of buckets the aggregation window is split into.
+// The aggregates cover the buckets overlapping the window, so up to a bucket
+// more than the window.
+const windowBuckets = 6
+
+// aggregateSize is the memory used by an aggregate beside its key and labels.
+const aggregateSize = 64
+
+// WindowValue is a value of stats to aggregate over the aggregation window,
+// such as a gauge of a metric, identified by Metric and Labels.
+type WindowValue struct {
+	Metric string
+	Labels []string
+	Value  float64
+}
+
+// WindowValuesFunc returns the values of stats to aggregate.
+type WindowValuesFunc func(stats *docker.ContainerStats) []WindowValue
+
+// WindowAggregate is the min, max and sum of the Count values of a series
+// added over the aggregation window.
+type WindowAggregate struct {
+	Metric string
+	Labels []string
+	Min    float64
+	Max    float64
+	Sum    float64
+	Count  int
+}
+
+func (a *WindowAggregate) add(value float64) {
+	if a.Count == 0 || value < a.Min {
+		a.Min = value
+	}
+	if a.Count == 0 || value > a.Max {
+		a.Max = value
+	}
+	a.Sum += value
+	a.Count++
+}
+
+func (a *WindowAggregate) merge(other *WindowAggregate) {
+	if a.Count == 0 || other.Min < a.Min {
+		a.Min = other.Min
+	}
+	if a.Count == 0 || other.Max > a.Max {
+		a.Max = other.Max
+	}
+	a.Sum += other.Sum
+	a.Count += other.Count
+}
+
+// window keeps running aggregates of the values added over the aggregation
+// window by bucket, so that its memory is bounded by the series rather than
+// the samples.
+type window struct {
+	length time.Duration
+	// buckets are ordered from the oldest.
+	buckets []*windowBucket
+	bytes   int64
+}
+
+type windowBucket struct {
+	start      time.Time
+	keys       []string
+	aggregates map[string]*WindowAggregate
+	bytes      int64
+}
+
+func newWindow(length time.Duration) *window {
+	return &window{length: length}
+}
+
+func (w *window) bucketLength() time.Duration {
+	if l := w.length / windowBuckets; l > 0 {
+		return l
+	}
+	return w.length
+}
+
+// add aggregates the values of stats collected at t in their bucket, and drops
+// the buckets which left the window. Values older than the window are
+// ignored.
+func (w *window) add(t time.Time, values []WindowValue) {
+	bucketLength := w.bucketLength()
+	start := t.Truncate(bucketLength)
+	if n := len(w.buckets); n > 0 && !start.Add(bucketLength).After(w.buckets[n-1].start.Add(bucketLength-w.length)) {
+		return
+	}
+
+	i := len(w.buckets)
+	for i > 0 && w.buckets[i-1].start.After(start) {
+		i--
+	}
+	if i == 0 || !w.buckets[i-1].start.Equal(start) {
+		b := &windowBucket{start: start, aggregates: make(map[string]*WindowAggregate)}
+		w.buckets = append(w.buckets, nil)
+		copy(w.buckets[i+1:], w.buckets[i:])
+		w.buckets[i] = b
+		i++
+	}
+	b := w.buckets[i-1]
+
+	bytes := b.bytes
+	for _, v := range values {
+		key := v.Metric + "\xff" + strings.Join(v.Labels, "\xff")
+		a, ok := b.aggregates[key]
+		if !ok {
+			a = &WindowAggregate{Metric: v.Metric, Labels: v.Labels}
+			b.aggregates[key] = a
+			b.keys = append(b.keys, key)
+			b.bytes += aggregateSize + 2*int64(len(key))
+		}
+		a.add(v.Value)
+	}
+	w.bytes += b.bytes - bytes
+
+	end := w.buckets[len(w.buckets)-1].start.Add(bucketLength)
+	for len(w.buckets) > 0 && !w.buckets[0].start.Add(bucketLength).After(end.Add(-w.length)) {
+		w.bytes -= w.buckets[0].bytes
+		w.buckets = w.buckets[1:]
+	}
+}
+
+// aggregates merges the buckets into the aggregates of the window, in the
+// order their series were first added.
+func (w *window) aggregates() []WindowAggregate {
+	var keys []string
+	merged := make(map[string]*WindowAggregate)
+	for _, b := range w.buckets {
+		for _, key := range b.keys {
+			a := b.aggregates[key]
+			m, ok := merged[key]
+			if !ok {
+				m = &WindowAggregate{Metric: a.Metric, Labels: a.Labels}
+				merged[key] = m
+				keys = append(keys, key)
+			}
+			m.merge(a)
+		}
+	}
+
+	aggregates := make([]WindowAggregate, 0, len(keys))
+	for _, key := range keys {
+		aggregates = append(aggregates, *merged[key])
+	}
+	return aggregates
+}